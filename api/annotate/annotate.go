@@ -0,0 +1,317 @@
+package annotate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/audit"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	"github.com/logzio/ezkonnect-server/api/metrics"
+	"go.uber.org/zap"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"time"
+)
+
+const (
+	StatusUpdated   = "updated"
+	StatusUnchanged = "unchanged"
+	StatusFailed    = "failed"
+	// StatusSkipped is reported in atomic mode for the resources after the first failure
+	StatusSkipped = "skipped"
+	// RollbackSucceeded and RollbackFailed are the outcomes of restoring a resource in atomic mode
+	RollbackSucceeded = "rolled_back"
+	RollbackFailed    = "failed"
+)
+
+// ResourceResult is the outcome of annotating a single resource
+// name: name of the resource
+// kind: kind of the resource (deployment, statefulset, daemonset, cronjob, job or rollout)
+// namespace: namespace of the resource
+// updated_annotations: updated annotations of the resource
+// status: updated, unchanged, failed or skipped
+// changed: whether the pod template annotations were changed, unchanged resources are not sent to Kubernetes
+// rollout_triggered: whether the change replaces the running pods of the resource
+// error: the reason of the failure, only set for failed resources
+// dry_run: preview of the change, only set for dry run requests
+// rollback: the outcome of restoring the resource's annotations, only set for updated resources of failed atomic requests
+type ResourceResult struct {
+	Name               string            `json:"name"`
+	Namespace          string            `json:"namespace"`
+	Kind               string            `json:"controller_kind"`
+	UpdatedAnnotations map[string]string `json:"updated_annotations"`
+	Status             string            `json:"status"`
+	Changed            bool              `json:"changed"`
+	RolloutTriggered   bool              `json:"rollout_triggered"`
+	Error              *ResourceError    `json:"error,omitempty"`
+	DryRun             *api.DryRunResult `json:"dry_run,omitempty"`
+	Rollback           *RollbackResult   `json:"rollback,omitempty"`
+}
+
+// RollbackResult is the outcome of restoring a resource's pod template annotations after a failed atomic request
+// status: rolled_back or failed
+// error: the reason of the failure, only set when the rollback failed
+type RollbackResult struct {
+	Status string         `json:"status"`
+	Error  *ResourceError `json:"error,omitempty"`
+}
+
+// ResourceError describes why annotating a resource failed
+// code: the Kubernetes status reason, for example NotFound, Conflict or Forbidden
+// message: the error message
+// conflicts: the annotations owned by other field managers, only set for server-side apply conflicts
+type ResourceError struct {
+	Code      string                     `json:"code"`
+	Message   string                     `json:"message"`
+	Conflicts []api.FieldManagerConflict `json:"conflicts,omitempty"`
+}
+
+// newResourceError builds a ResourceError from a Kubernetes client error
+func newResourceError(err error) *ResourceError {
+	code := string(apierrors.ReasonForError(err))
+	if code == string(v1.StatusReasonUnknown) {
+		code = string(v1.StatusReasonInternalError)
+	}
+	return &ResourceError{Code: code, Message: err.Error(), Conflicts: api.FieldManagerConflicts(err)}
+}
+
+// annotationChange is a pod template annotations change requested for a single resource
+// annotations are the annotations reported in the result, mutate applies the change to the current annotations
+// and outcome is the metrics outcome counted when the change is applied, see metrics.ObserveAnnotate.
+// operation, action, serviceName and logType describe the change in the audit trail and events, see audit.Entry.
+type annotationChange struct {
+	name        string
+	kind        string
+	namespace   string
+	annotations map[string]string
+	mutate      func(annotations map[string]string)
+	outcome     string
+	operation   string
+	action      string
+	serviceName string
+	logType     string
+}
+
+// annotateResources applies the annotation changes one by one and returns a result per change.
+// A failed change doesn't stop the remaining changes, failed reports whether any of them failed.
+// In atomic mode the changes after the first failure are skipped, and the already updated resources are restored.
+// Every change that is not skipped is recorded in the audit trail, except in dry runs, see recordChange.
+func annotateResources(ctx context.Context, logger zap.SugaredLogger, clients api.Clients, changes []annotationChange, options annotateOptions) ([]ResourceResult, bool) {
+	results := make([]ResourceResult, 0, len(changes))
+	// snapshots of the updated resources by result index, used to restore them in atomic mode
+	snapshots := map[int]annotationSnapshot{}
+	failed := false
+	for _, change := range changes {
+		result := ResourceResult{
+			Name:               change.name,
+			Namespace:          change.namespace,
+			Kind:               change.kind,
+			UpdatedAnnotations: change.annotations,
+		}
+		if failed && options.atomic {
+			result.Status = StatusSkipped
+			results = append(results, result)
+			continue
+		}
+		// Some workloads are managed through another workload, such as jobs created by a CronJob
+		kind, name, err := api.ResolveWorkload(ctx, clients, change.kind, change.namespace, change.name)
+		if err != nil {
+			logger.Error(api.ErrorGet, err)
+			result.Status, result.Error = StatusFailed, newResourceError(err)
+			results, failed = append(results, result), true
+			metrics.ObserveAnnotate(change.kind, metrics.OutcomeFailed)
+			recordChange(ctx, options, change, result, nil, nil, metrics.OutcomeFailed)
+			continue
+		}
+		result.Kind, result.Name = kind, name
+		// The caller must be allowed to patch the workload, not only the server
+		if err := authorizeWorkload(ctx, kind, change.namespace, name); err != nil {
+			logger.Error(api.ErrorForbidden, err)
+			result.Status, result.Error = StatusFailed, newResourceError(err)
+			results, failed = append(results, result), true
+			metrics.ObserveAnnotate(kind, metrics.OutcomeFailed)
+			recordChange(ctx, options, change, result, nil, nil, metrics.OutcomeFailed)
+			continue
+		}
+
+		logger.Info("Updating ", kind, ": ", name)
+		update, err := options.updateAnnotations(ctx, clients, kind, change.namespace, name, change.mutate)
+		if err != nil {
+			logger.Error(api.ErrorUpdate, err)
+			result.Status, result.Error = StatusFailed, newResourceError(err)
+			results, failed = append(results, result), true
+			metrics.ObserveAnnotate(kind, metrics.OutcomeFailed)
+			recordChange(ctx, options, change, result, nil, nil, metrics.OutcomeFailed)
+			continue
+		}
+		result.Changed = update.Changed()
+		result.RolloutTriggered = update.RolloutTriggered
+		result.Status = StatusUpdated
+		if !result.Changed {
+			result.Status = StatusUnchanged
+		}
+		outcome := change.outcome
+		if !result.Changed {
+			outcome = metrics.OutcomeUnchanged
+		}
+		if options.dryRun {
+			result.DryRun = api.NewDryRunResult(update)
+		} else {
+			metrics.ObserveAnnotate(kind, outcome)
+		}
+		recordChange(ctx, options, change, result, update.Before, update.After, outcome)
+		if result.Status == StatusUpdated {
+			snapshots[len(results)] = annotationSnapshot{before: update.Before, after: update.After}
+		}
+		results = append(results, result)
+	}
+	if failed && options.atomic && !options.dryRun {
+		// Restore even if the client went away, the request context may already be cancelled
+		rollbackResources(detachedContext{ctx}, logger, clients, results, snapshots, options)
+	}
+	return results, failed
+}
+
+// authorizeWorkload checks that the caller may patch the workload, see auth.Authorize.
+// In impersonation mode Kubernetes authorizes the patch itself.
+func authorizeWorkload(ctx context.Context, kind string, namespace string, name string) error {
+	if auth.ImpersonationEnabled() {
+		return nil
+	}
+	resource, err := api.WorkloadGroupResource(kind)
+	if err != nil {
+		return err
+	}
+	return auth.Authorize(ctx, authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "patch",
+		Group:     resource.Group,
+		Resource:  resource.Resource,
+		Name:      name,
+	})
+}
+
+// recordChange records the outcome of a change to a resource in the audit trail, whose event sink emits a
+// Kubernetes Event on the resource. Dry runs are not recorded.
+func recordChange(ctx context.Context, options annotateOptions, change annotationChange, result ResourceResult, before map[string]string, after map[string]string, outcome string) {
+	if options.dryRun {
+		return
+	}
+	entry := audit.Entry{
+		Operation:   change.operation,
+		Action:      change.action,
+		ServiceName: change.serviceName,
+		LogType:     change.logType,
+		Kind:        result.Kind,
+		Namespace:   result.Namespace,
+		Name:        result.Name,
+		Before:      before,
+		After:       after,
+		Outcome:     outcome,
+	}
+	if result.Error != nil {
+		entry.Error = result.Error.Message
+	}
+	audit.Record(ctx, entry)
+}
+
+// detachedContext keeps the values of a request context, such as its caller, without its cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// annotationSnapshot holds the pod template annotations of a resource before and after its change
+type annotationSnapshot struct {
+	before map[string]string
+	after  map[string]string
+}
+
+// rollbackResources restores the annotations of the updated resources from their snapshots, in reverse order.
+// Only the annotations changed by the request are restored, so concurrent changes to other annotations are kept.
+func rollbackResources(ctx context.Context, logger zap.SugaredLogger, clients api.Clients, results []ResourceResult, snapshots map[int]annotationSnapshot, options annotateOptions) {
+	for i := len(results) - 1; i >= 0; i-- {
+		snapshot, ok := snapshots[i]
+		if !ok {
+			continue
+		}
+		result := &results[i]
+		logger.Info("Rolling back ", result.Kind, ": ", result.Name)
+		update, err := options.updateAnnotations(ctx, clients, result.Kind, result.Namespace, result.Name, func(current map[string]string) {
+			restoreAnnotations(current, snapshot.before, snapshot.after)
+		})
+		if err != nil {
+			logger.Error(api.ErrorRollback, err)
+			result.Rollback = &RollbackResult{Status: RollbackFailed, Error: newResourceError(err)}
+			recordChange(ctx, options, annotationChange{operation: audit.OperationRollback}, ResourceResult{
+				Name:      result.Name,
+				Namespace: result.Namespace,
+				Kind:      result.Kind,
+				Error:     result.Rollback.Error,
+			}, nil, nil, metrics.OutcomeFailed)
+			continue
+		}
+		result.Rollback = &RollbackResult{Status: RollbackSucceeded}
+		metrics.ObserveAnnotate(result.Kind, metrics.OutcomeReverted)
+		recordChange(ctx, options, annotationChange{operation: audit.OperationRollback}, *result, update.Before, update.After, metrics.OutcomeReverted)
+	}
+}
+
+// restoreAnnotations reverts the keys that differ between before and after to their value in before
+func restoreAnnotations(current map[string]string, before map[string]string, after map[string]string) {
+	for k, v := range after {
+		if previous, ok := before[k]; !ok {
+			delete(current, k)
+		} else if previous != v {
+			current[k] = previous
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			current[k] = v
+		}
+	}
+}
+
+// writeResults writes the per resource results, with 207 Multi-Status when some of the resources failed,
+// or 409 Conflict when no resource was changed because of field manager conflicts
+func writeResults(w http.ResponseWriter, results []ResourceResult, failed bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if failed && onlyFieldManagerConflicts(results) {
+		w.WriteHeader(http.StatusConflict)
+	} else if failed {
+		w.WriteHeader(http.StatusMultiStatus)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// onlyFieldManagerConflicts reports whether every resource either failed with a field manager conflict or was skipped
+func onlyFieldManagerConflicts(results []ResourceResult) bool {
+	for _, result := range results {
+		switch result.Status {
+		case StatusSkipped:
+		case StatusFailed:
+			if result.Error == nil || len(result.Error.Conflicts) == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
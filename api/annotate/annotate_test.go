@@ -0,0 +1,279 @@
+package annotate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/logzio/ezkonnect-server/api"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// deploymentsGroupResource is the group resource of the errors returned by the reactors
+var deploymentsGroupResource = schema.GroupResource{Group: "apps", Resource: "deployments"}
+
+// deployment returns a deployment of the shop namespace with the given pod template annotations
+func deployment(name string, annotations map[string]string) *appsv1.Deployment {
+	object := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "shop"}}
+	object.Spec.Template.Annotations = annotations
+	return object
+}
+
+// useFakeClients makes the handlers use a fake clientset holding the given objects
+func useFakeClients(t *testing.T, objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	api.SetClientFactory(api.NewClientFactoryForClients(api.Clients{Kube: clientset}))
+	t.Cleanup(func() {
+		api.SetClientFactory(nil)
+	})
+	return clientset
+}
+
+// failPatches makes the patches of the named deployments fail with err
+func failPatches(clientset *fake.Clientset, err error, names ...string) {
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		for _, name := range names {
+			if action.(k8stesting.PatchAction).GetName() == name {
+				return true, nil, err
+			}
+		}
+		return false, nil, nil
+	})
+}
+
+// podTemplateAnnotations returns the pod template annotations of a deployment of the shop namespace
+func podTemplateAnnotations(t *testing.T, clientset *fake.Clientset, name string) map[string]string {
+	t.Helper()
+	object, err := clientset.Tracker().Get(schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, "shop", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return object.(*appsv1.Deployment).Spec.Template.Annotations
+}
+
+// patchedNames returns the names of the patched deployments in order
+func patchedNames(clientset *fake.Clientset) []string {
+	var names []string
+	for _, action := range clientset.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			names = append(names, patch.GetName())
+		}
+	}
+	return names
+}
+
+// postTraces sends a traces request for the add action on the named deployments of the shop namespace
+func postTraces(t *testing.T, query string, names ...string) (int, []ResourceResult) {
+	t.Helper()
+	var resources []TracesResourceRequest
+	for _, name := range names {
+		resources = append(resources, TracesResourceRequest{Name: name, Kind: api.KindDeployment, Namespace: "shop", Action: api.ActionAdd})
+	}
+	body, _ := json.Marshal(resources)
+	recorder := httptest.NewRecorder()
+	UpdateTracesResourceAnnotations(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/annotate/traces"+query, strings.NewReader(string(body))))
+	var results []ResourceResult
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding %q: %v", recorder.Body.String(), err)
+	}
+	return recorder.Code, results
+}
+
+// statuses returns the status of every result
+func statuses(results []ResourceResult) []string {
+	var statuses []string
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	return statuses
+}
+
+func TestAnnotateContinuesAfterFailures(t *testing.T) {
+	clientset := useFakeClients(t, deployment("cart", nil), deployment("payments", nil), deployment("checkout", nil))
+	failPatches(clientset, apierrors.NewForbidden(deploymentsGroupResource, "payments", nil), "payments")
+
+	code, results := postTraces(t, "", "cart", "missing", "payments", "checkout")
+	if code != http.StatusMultiStatus {
+		t.Errorf("status code = %d, want 207", code)
+	}
+	want := []string{StatusUpdated, StatusFailed, StatusFailed, StatusUpdated}
+	if got := statuses(results); !reflect.DeepEqual(got, want) {
+		t.Fatalf("statuses = %v, want %v", got, want)
+	}
+	// A failed Get and a failed Patch are both reported with their Kubernetes reason
+	for i, code := range map[int]string{1: "NotFound", 2: "Forbidden"} {
+		if results[i].Error == nil || results[i].Error.Code != code || results[i].Error.Message == "" {
+			t.Errorf("%s error = %+v, want %s with a message", results[i].Name, results[i].Error, code)
+		}
+	}
+	for _, result := range []ResourceResult{results[0], results[3]} {
+		if result.Error != nil || !result.Changed || !result.RolloutTriggered {
+			t.Errorf("%s result = %+v, want a changed resource", result.Name, result)
+		}
+	}
+	for _, name := range []string{"cart", "checkout"} {
+		if annotations := podTemplateAnnotations(t, clientset, name); annotations[InstrumentationAnnotation] != "true" {
+			t.Errorf("%s annotations = %v, want it instrumented", name, annotations)
+		}
+	}
+}
+
+func TestAnnotateStatusCodes(t *testing.T) {
+	clientset := useFakeClients(t, deployment("cart", map[string]string{InstrumentationAnnotation: "true"}), deployment("checkout", nil))
+
+	code, results := postTraces(t, "", "cart", "checkout")
+	if code != http.StatusOK {
+		t.Errorf("status code = %d, want 200", code)
+	}
+	if got := statuses(results); !reflect.DeepEqual(got, []string{StatusUnchanged, StatusUpdated}) {
+		t.Errorf("statuses = %v, want unchanged and updated", got)
+	}
+	// Unchanged resources are not sent to Kubernetes
+	if names := patchedNames(clientset); !reflect.DeepEqual(names, []string{"checkout"}) {
+		t.Errorf("patched %v, want only checkout", names)
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	conflict := &ResourceError{Code: "Conflict", Conflicts: []api.FieldManagerConflict{{Manager: "argocd", Field: ".spec"}}}
+	tests := []struct {
+		name     string
+		results  []ResourceResult
+		failed   bool
+		expected int
+	}{
+		{"all updated", []ResourceResult{{Status: StatusUpdated}, {Status: StatusUnchanged}}, false, http.StatusOK},
+		{"some failed", []ResourceResult{{Status: StatusUpdated}, {Status: StatusFailed, Error: &ResourceError{Code: "NotFound"}}}, true, http.StatusMultiStatus},
+		{"only conflicts", []ResourceResult{{Status: StatusFailed, Error: conflict}, {Status: StatusSkipped}}, true, http.StatusConflict},
+		{"conflicts and other failures", []ResourceResult{{Status: StatusFailed, Error: conflict}, {Status: StatusFailed, Error: &ResourceError{Code: "NotFound"}}}, true, http.StatusMultiStatus},
+		{"conflicts and updates", []ResourceResult{{Status: StatusFailed, Error: conflict}, {Status: StatusUpdated}}, true, http.StatusMultiStatus},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			writeResults(recorder, test.results, test.failed)
+			if recorder.Code != test.expected {
+				t.Errorf("status code = %d, want %d", recorder.Code, test.expected)
+			}
+			var results []ResourceResult
+			if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil || len(results) != len(test.results) {
+				t.Errorf("body = %s, want the %d results", recorder.Body.String(), len(test.results))
+			}
+		})
+	}
+}
+
+func TestAtomicRestoresUpdatedResources(t *testing.T) {
+	clientset := useFakeClients(t, deployment("cart", nil), deployment("checkout", nil), deployment("payments", nil), deployment("orders", nil))
+	failPatches(clientset, apierrors.NewForbidden(deploymentsGroupResource, "payments", nil), "payments")
+
+	code, results := postTraces(t, "?atomic=true", "cart", "checkout", "payments", "orders")
+	if code != http.StatusMultiStatus {
+		t.Errorf("status code = %d, want 207", code)
+	}
+	want := []string{StatusUpdated, StatusUpdated, StatusFailed, StatusSkipped}
+	if got := statuses(results); !reflect.DeepEqual(got, want) {
+		t.Fatalf("statuses = %v, want %v", got, want)
+	}
+	for _, result := range results[:2] {
+		if result.Rollback == nil || result.Rollback.Status != RollbackSucceeded {
+			t.Errorf("%s rollback = %+v, want rolled_back", result.Name, result.Rollback)
+		}
+		if annotations := podTemplateAnnotations(t, clientset, result.Name); len(annotations) != 0 {
+			t.Errorf("%s annotations = %v, want them restored", result.Name, annotations)
+		}
+	}
+	if results[2].Rollback != nil || results[3].Rollback != nil {
+		t.Errorf("failed and skipped resources have a rollback: %+v, %+v", results[2].Rollback, results[3].Rollback)
+	}
+	// The updated resources are restored in reverse order and the skipped resource is never sent
+	if names := patchedNames(clientset); !reflect.DeepEqual(names, []string{"cart", "checkout", "payments", "checkout", "cart"}) {
+		t.Errorf("patched %v", names)
+	}
+}
+
+func TestAtomicRestoresOnlyChangedKeys(t *testing.T) {
+	clientset := useFakeClients(t, deployment("cart", map[string]string{"team": "shop"}), deployment("payments", nil), deployment("checkout", nil))
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.PatchAction).GetName() != "payments" {
+			return false, nil, nil
+		}
+		// Another client changes cart while the request is running
+		concurrent := deployment("cart", map[string]string{"team": "payments", "owner": "sre", InstrumentationAnnotation: "true"})
+		if err := clientset.Tracker().Update(deployments, concurrent, "shop"); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, apierrors.NewForbidden(deploymentsGroupResource, "payments", nil)
+	})
+
+	_, results := postTraces(t, "?atomic=true", "cart", "payments", "checkout")
+	if got := statuses(results); !reflect.DeepEqual(got, []string{StatusUpdated, StatusFailed, StatusSkipped}) {
+		t.Fatalf("statuses = %v", got)
+	}
+	if results[0].Rollback == nil || results[0].Rollback.Status != RollbackSucceeded {
+		t.Errorf("cart rollback = %+v, want rolled_back", results[0].Rollback)
+	}
+	// Only the instrumentation annotation added by the request is reverted
+	want := map[string]string{"team": "payments", "owner": "sre"}
+	if annotations := podTemplateAnnotations(t, clientset, "cart"); !reflect.DeepEqual(annotations, want) {
+		t.Errorf("cart annotations = %v, want %v", annotations, want)
+	}
+	if annotations := podTemplateAnnotations(t, clientset, "checkout"); len(annotations) != 0 {
+		t.Errorf("skipped checkout annotations = %v", annotations)
+	}
+}
+
+func TestAtomicReportsFailedRestores(t *testing.T) {
+	clientset := useFakeClients(t, deployment("cart", nil), deployment("payments", nil))
+	failPatches(clientset, apierrors.NewForbidden(deploymentsGroupResource, "payments", nil), "payments")
+	cartPatches := 0
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.PatchAction).GetName() != "cart" {
+			return false, nil, nil
+		}
+		// The update goes through, the restore fails
+		if cartPatches++; cartPatches == 1 {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewServiceUnavailable("the API server is shutting down")
+	})
+
+	code, results := postTraces(t, "?atomic=true", "cart", "payments")
+	if code != http.StatusMultiStatus {
+		t.Errorf("status code = %d, want 207", code)
+	}
+	rollback := results[0].Rollback
+	if rollback == nil || rollback.Status != RollbackFailed || rollback.Error == nil || rollback.Error.Code != "ServiceUnavailable" {
+		t.Errorf("cart rollback = %+v, want failed with ServiceUnavailable", rollback)
+	}
+	if annotations := podTemplateAnnotations(t, clientset, "cart"); annotations[InstrumentationAnnotation] != "true" {
+		t.Errorf("cart annotations = %v, want the update kept after the failed restore", annotations)
+	}
+}
+
+func TestAtomicDryRunNeverRestores(t *testing.T) {
+	clientset := useFakeClients(t, deployment("cart", nil), deployment("payments", nil), deployment("checkout", nil))
+	failPatches(clientset, apierrors.NewForbidden(deploymentsGroupResource, "payments", nil), "payments")
+
+	_, results := postTraces(t, "?atomic=true&dryRun=true", "cart", "payments", "checkout")
+	if got := statuses(results); !reflect.DeepEqual(got, []string{StatusUpdated, StatusFailed, StatusSkipped}) {
+		t.Fatalf("statuses = %v", got)
+	}
+	if results[0].Rollback != nil || results[0].DryRun == nil {
+		t.Errorf("cart result = %+v, want a dry run preview without rollback", results[0])
+	}
+	// Only the dry run patches are sent, nothing was persisted so nothing is restored
+	if names := patchedNames(clientset); !reflect.DeepEqual(names, []string{"cart", "payments"}) {
+		t.Errorf("patched %v, want the dry run patches only", names)
+	}
+}
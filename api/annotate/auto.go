@@ -0,0 +1,98 @@
+package annotate
+
+import (
+	"context"
+	"errors"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/state"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"net/http"
+)
+
+// QueryNamespace limits automatic instrumentation to a single namespace
+const QueryNamespace = "namespace"
+
+// AutoInstrumentTraces instruments every workload that the detection found ready for automatic instrumentation,
+// see state.ListInstrumentationCandidates. The workloads are limited to a namespace with the namespace query parameter,
+// and the annotate query parameters apply, so dryRun=true previews the workloads that would be instrumented.
+// When authorization is enabled, only the candidates of the namespaces whose state the caller may read are instrumented.
+func AutoInstrumentTraces(w http.ResponseWriter, r *http.Request) {
+	logger := api.InitLogger()
+	options, err := parseAnnotateOptions(r.URL.Query())
+	if err != nil {
+		logger.Error(api.ErrorInvalidInput, err)
+		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusBadRequest)
+		return
+	}
+	candidates, err := state.ListInstrumentationCandidates(r.URL.Query().Get(QueryNamespace), api.AutoInstrumentationLanguages)
+	if errors.Is(err, state.ErrCacheNotSynced) {
+		logger.Warn(api.ErrorCacheNotSynced)
+		http.Error(w, api.ErrorCacheNotSynced, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logger.Error(api.ErrorList, err)
+		http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The candidates come from the server's cache, hide the namespaces the caller can't read
+	allows := state.NamespaceFilter(r.Context())
+	allowed := candidates[:0]
+	for _, candidate := range candidates {
+		ok, err := allows(candidate.Namespace)
+		if err != nil {
+			logger.Error(api.ErrorForbidden, err)
+			http.Error(w, api.ErrorForbidden+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			allowed = append(allowed, candidate)
+		}
+	}
+	candidates = allowed
+	// Get the Kubernetes clients, impersonating the caller in impersonation mode
+	clients, err := api.GetRequestClients(r.Context())
+	if err != nil {
+		logger.Error(api.ErrorKubeClient, err)
+		http.Error(w, api.ErrorKubeClient+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changes := candidateChanges(r.Context(), logger, clients, candidates)
+	logger.Info("Instrumenting ", len(changes), " workloads")
+	responses, failed := annotateResources(r.Context(), logger, clients, changes, options)
+	writeResults(w, responses, failed)
+}
+
+// candidateChanges builds the traces add change of every candidate workload. Jobs created by a CronJob instrument
+// their CronJob once, since every run has its own custom resource. Standalone jobs are skipped, Kubernetes doesn't
+// allow changing the pod template of a started job.
+func candidateChanges(ctx context.Context, logger zap.SugaredLogger, clients api.Clients, candidates []state.InstrumentationCandidate) []annotationChange {
+	changes := make([]annotationChange, 0, len(candidates))
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		kind, name, err := api.ResolveWorkload(ctx, clients, candidate.Kind, candidate.Namespace, candidate.Name)
+		// A job that is gone has finished, so there is nothing to instrument either
+		if kind == api.KindJob || (candidate.Kind == api.KindJob && apierrors.IsNotFound(err)) {
+			logger.Info("Skipping standalone job: ", candidate.Namespace, "/", candidate.Name)
+			continue
+		}
+		if err != nil {
+			// Reported as a failed resource by annotateResources
+			kind, name = candidate.Kind, candidate.Name
+		}
+		key := candidate.Namespace + "/" + kind + "/" + name
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		changes = append(changes, tracesAnnotationChange(TracesResourceRequest{
+			Name:      name,
+			Kind:      kind,
+			Namespace: candidate.Namespace,
+			Action:    api.ActionAdd,
+		}))
+	}
+	return changes
+}
@@ -0,0 +1,52 @@
+package annotate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/state"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// job returns a job of the shop namespace, created by the named CronJob when it isn't empty
+func job(name string, cronJob string) *batchv1.Job {
+	object := &batchv1.Job{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "shop"}}
+	if cronJob != "" {
+		controller := true
+		object.OwnerReferences = []v1.OwnerReference{{APIVersion: "batch/v1", Kind: "CronJob", Name: cronJob, Controller: &controller}}
+	}
+	return object
+}
+
+func TestCandidateChanges(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		job("report-1", "report"),
+		job("report-2", "report"),
+		job("migration", ""),
+	)
+	candidates := []state.InstrumentationCandidate{
+		{Name: "api", Namespace: "shop", Kind: api.KindDeployment},
+		{Name: "report-1", Namespace: "shop", Kind: api.KindJob},
+		{Name: "migration", Namespace: "shop", Kind: api.KindJob},
+		{Name: "report-2", Namespace: "shop", Kind: api.KindJob},
+		// Deleted after it completed
+		{Name: "cleanup", Namespace: "shop", Kind: api.KindJob},
+	}
+
+	changes := candidateChanges(context.Background(), api.InitLogger(), api.Clients{Kube: clientset}, candidates)
+	var workloads []string
+	for _, change := range changes {
+		workloads = append(workloads, change.kind+"/"+change.name)
+		if change.action != api.ActionAdd || change.namespace != "shop" {
+			t.Errorf("change = %+v, want an add in the shop namespace", change)
+		}
+	}
+	// The CronJob is instrumented once and the standalone jobs are skipped
+	if want := []string{"deployment/api", "cronjob/report"}; !reflect.DeepEqual(workloads, want) {
+		t.Errorf("workloads = %v, want %v", workloads, want)
+	}
+}
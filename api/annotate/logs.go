@@ -1,22 +1,23 @@
 package annotate
 
 import (
-	"encoding/json"
+	"context"
 	"github.com/logzio/ezkonnect-server/api"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"github.com/logzio/ezkonnect-server/api/audit"
+	"github.com/logzio/ezkonnect-server/api/metrics"
+	"io"
 	"net/http"
 	"strings"
 )
 
 const (
-	LogTypeAnnotation = "logz.io/application_type"
+	LogTypeAnnotation = api.LogTypeAnnotation
 )
 
 // LogsResourceRequest is the JSON body of the POST request
 // It contains the name, controller_kind, namespace, and log type of the resource
 // name: name of the resource
-// controller_kind: kind of the resource (deployment or statefulset)
+// controller_kind: kind of the resource (deployment, statefulset, daemonset, cronjob, job or rollout)
 // namespace: namespace of the resource
 // log_type: desired log type
 type LogsResourceRequest struct {
@@ -26,39 +27,59 @@ type LogsResourceRequest struct {
 	LogType   string `json:"log_type"`
 }
 
-// LogsResourceResponse is the JSON response of the POST request
-// It contains the name, kind, namespace and updated annotations of the resource
-// name: name of the resource
-// kind: kind of the resource (deployment or statefulset) consts defined at `common.go` (api.KindDeployment, api.KindStatefulSet)
-// namespace: namespace of the resource
-// updated_annotations: updated annotations of the resource
-type LogsResourceResponse struct {
-	Name               string            `json:"name"`
-	Namespace          string            `json:"namespace"`
-	Kind               string            `json:"controller_kind"`
-	UpdatedAnnotations map[string]string `json:"updated_annotations"`
+// LogsSelectorRequest is the selector form of the JSON body of the POST request, it sets the log type
+// of all the workloads matched by the selector, see WorkloadSelector
+// log_type: desired log type, an empty log type removes it
+type LogsSelectorRequest struct {
+	WorkloadSelector
+	LogType string `json:"log_type"`
+}
+
+// resources returns a request per workload matched by the selector
+func (selector LogsSelectorRequest) resources(ctx context.Context, clients api.Clients) ([]LogsResourceRequest, error) {
+	workloads, err := selectWorkloads(ctx, clients, selector.WorkloadSelector)
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]LogsResourceRequest, 0, len(workloads))
+	for _, workload := range workloads {
+		resources = append(resources, LogsResourceRequest{
+			Name:      workload.name,
+			Kind:      workload.kind,
+			Namespace: selector.Namespace,
+			LogType:   selector.LogType,
+		})
+	}
+	return resources, nil
 }
 
+// LogsResourceResponse is the JSON response of the POST request, one per requested resource, see ResourceResult
+type LogsResourceResponse = ResourceResult
+
 func UpdateLogsResourceAnnotations(w http.ResponseWriter, r *http.Request) {
 	logger := api.InitLogger()
-	// Decode JSON body
-	var resources []LogsResourceRequest
-	err := json.NewDecoder(r.Body).Decode(&resources)
+	options, err := parseAnnotateOptions(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		logger.Error(api.ErrorInvalidInput, err)
+		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Get the Kubernetes config
-	config, err := api.GetConfig()
+	// Read the JSON body, either an array of resources or a selector, see decodeResourceRequests
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.Error(api.ErrorKubeConfig, err)
-		http.Error(w, api.ErrorKubeConfig, http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	// Get the Kubernetes clients, impersonating the caller in impersonation mode
+	clients, err := api.GetRequestClients(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error(api.ErrorKubeClient, err)
+		http.Error(w, api.ErrorKubeClient+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Decode the body, listing the workloads of a selector
+	resources, ok := decodeResourceRequests[LogsResourceRequest, LogsSelectorRequest](r.Context(), w, logger, clients, body)
+	if !ok {
 		return
 	}
 
@@ -72,82 +93,36 @@ func UpdateLogsResourceAnnotations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Update the resources
-	var responses []LogsResourceResponse
+	changes := make([]annotationChange, 0, len(resources))
 	for _, resource := range resources {
 		value := resource.LogType
-		annotations := map[string]string{
-			LogTypeAnnotation: value,
-		}
-
-		// Create the response
-		response := LogsResourceResponse{
-			Name:               resource.Name,
-			Namespace:          resource.Namespace,
-			Kind:               resource.Kind,
-			UpdatedAnnotations: annotations,
-		}
-		switch resource.Kind {
-		case api.KindDeployment:
-			logger.Info("Updating deployment: ", resource.Name)
-			deployment, err := clientset.AppsV1().Deployments(resource.Namespace).Get(r.Context(), resource.Name, v1.GetOptions{})
-			if err != nil {
-				logger.Error(api.ErrorGet, err)
-				http.Error(w, api.ErrorGet+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			if deployment.Spec.Template.ObjectMeta.Annotations == nil {
-				deployment.Spec.Template.ObjectMeta.Annotations = make(map[string]string)
-			}
-
-			if len(value) != 0 {
-				deployment.Spec.Template.ObjectMeta.Annotations[LogTypeAnnotation] = value
-			} else {
-				delete(deployment.Spec.Template.ObjectMeta.Annotations, LogTypeAnnotation)
-			}
-
-			_, err = clientset.AppsV1().Deployments(resource.Namespace).Update(r.Context(), deployment, v1.UpdateOptions{})
-			if err != nil {
-				logger.Error(api.ErrorUpdate, err)
-				http.Error(w, api.ErrorUpdate+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			responses = append(responses, response)
-
-		case api.KindStatefulSet:
-			logger.Info("Updating statefulset: ", resource.Name)
-			statefulSet, err := clientset.AppsV1().StatefulSets(resource.Namespace).Get(r.Context(), resource.Name, v1.GetOptions{})
-			if err != nil {
-				logger.Error(api.ErrorGet, err)
-				http.Error(w, api.ErrorGet+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			if statefulSet.Spec.Template.ObjectMeta.Annotations == nil {
-				statefulSet.Spec.Template.ObjectMeta.Annotations = make(map[string]string)
-			}
-
-			if len(value) != 0 {
-				statefulSet.Spec.Template.ObjectMeta.Annotations[LogTypeAnnotation] = value
-			} else {
-				delete(statefulSet.Spec.Template.ObjectMeta.Annotations, LogTypeAnnotation)
-			}
-
-			_, err = clientset.AppsV1().StatefulSets(resource.Namespace).Update(r.Context(), statefulSet, v1.UpdateOptions{})
-			if err != nil {
-				logger.Error(api.ErrorUpdate, err)
-				http.Error(w, api.ErrorUpdate+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			responses = append(responses, response)
+		outcome, action := metrics.OutcomeLogTypeSet, api.ActionAdd
+		if len(value) == 0 {
+			outcome, action = metrics.OutcomeLogTypeRemoved, api.ActionDelete
 		}
+		changes = append(changes, annotationChange{
+			name:      resource.Name,
+			kind:      resource.Kind,
+			namespace: resource.Namespace,
+			annotations: map[string]string{
+				LogTypeAnnotation: value,
+			},
+			mutate: func(current map[string]string) {
+				if len(value) != 0 {
+					current[LogTypeAnnotation] = value
+				} else {
+					delete(current, LogTypeAnnotation)
+				}
+			},
+			outcome:   outcome,
+			operation: audit.OperationLogs,
+			action:    action,
+			logType:   value,
+		})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(responses)
+	responses, failed := annotateResources(r.Context(), logger, clients, changes, options)
+	writeResults(w, responses, failed)
 }
 
 func isValidLogsResourceRequest(req LogsResourceRequest) bool {
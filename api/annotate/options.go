@@ -0,0 +1,87 @@
+package annotate
+
+import (
+	"context"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/url"
+	"strconv"
+)
+
+const (
+	QueryDryRun = "dryRun"
+	QueryAtomic = "atomic"
+	QueryApply  = "apply"
+	QueryForce  = "force"
+)
+
+// annotateOptions are the query parameters shared by the annotate endpoints
+// dryRun: validate the changes with a server-side dry run and return a preview without persisting them
+// atomic: apply the changes to all the resources or to none of them
+// apply: change the annotations with server-side apply, recording ezkonnect as their field manager
+// force: take ownership of annotations managed by other field managers instead of failing with a conflict, requires apply
+type annotateOptions struct {
+	dryRun bool
+	atomic bool
+	apply  bool
+	force  bool
+}
+
+// parseAnnotateOptions builds annotateOptions from the request query, returning an error for malformed values
+func parseAnnotateOptions(query url.Values) (annotateOptions, error) {
+	var options annotateOptions
+	if value := query.Get(QueryDryRun); value != "" {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s: %v", QueryDryRun, err)
+		}
+		options.dryRun = dryRun
+	}
+	if value := query.Get(QueryAtomic); value != "" {
+		atomic, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s: %v", QueryAtomic, err)
+		}
+		options.atomic = atomic
+	}
+	if value := query.Get(QueryApply); value != "" {
+		apply, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s: %v", QueryApply, err)
+		}
+		options.apply = apply
+	}
+	if value := query.Get(QueryForce); value != "" {
+		force, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid %s: %v", QueryForce, err)
+		}
+		options.force = force
+	}
+	if options.force && !options.apply {
+		return options, fmt.Errorf("%s requires %s", QueryForce, QueryApply)
+	}
+	return options, nil
+}
+
+// patchOptions returns the Kubernetes patch options matching the request options
+func (options annotateOptions) patchOptions() v1.PatchOptions {
+	opts := v1.PatchOptions{FieldManager: api.FieldManager}
+	if options.dryRun {
+		opts.DryRun = []string{v1.DryRunAll}
+	}
+	if options.force {
+		opts.Force = &options.force
+	}
+	return opts
+}
+
+// updateAnnotations changes the pod template annotations of a workload with a merge patch,
+// or with server-side apply when requested, and returns the change
+func (options annotateOptions) updateAnnotations(ctx context.Context, clients api.Clients, kind string, namespace string, name string, mutate func(annotations map[string]string)) (api.PodTemplateChange, error) {
+	if options.apply {
+		return api.ApplyPodTemplateAnnotations(ctx, clients, kind, namespace, name, mutate, options.patchOptions())
+	}
+	return api.UpdatePodTemplateAnnotations(ctx, clients, kind, namespace, name, mutate, options.patchOptions())
+}
@@ -0,0 +1,159 @@
+package annotate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	"go.uber.org/zap"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"strings"
+)
+
+// DefaultSelectorKinds are the kinds selected when a selector request doesn't list kinds
+var DefaultSelectorKinds = []string{api.KindDeployment, api.KindStatefulSet}
+
+// WorkloadSelector selects the workloads of a namespace by labels, it is the common part of the selector form
+// of the annotate requests
+// namespace: namespace of the workloads, required
+// label_selector: Kubernetes label selector the workloads must match, all the workloads of the namespace when empty
+// kinds: kinds of the workloads to select, deployment and statefulset when empty
+type WorkloadSelector struct {
+	Namespace     string   `json:"namespace"`
+	LabelSelector string   `json:"label_selector"`
+	Kinds         []string `json:"kinds"`
+}
+
+// errInvalidSelector is returned by selectWorkloads when the selector itself is invalid
+var errInvalidSelector = errors.New("invalid selector")
+
+// selectedWorkload is a workload matched by a WorkloadSelector
+type selectedWorkload struct {
+	kind string
+	name string
+}
+
+// isSelectorRequest reports whether a request body is a JSON object, the selector form, rather than an array of resources
+func isSelectorRequest(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && body[0] == '{'
+}
+
+// selectorRequest is the selector form of an annotate request, whose selected workloads become resource requests
+// of type R, see TracesSelectorRequest and LogsSelectorRequest
+type selectorRequest[R any] interface {
+	resources(ctx context.Context, clients api.Clients) ([]R, error)
+}
+
+// decodeResourceRequests decodes the body of an annotate request, either an array of resource requests or a selector
+// of type S whose workloads are listed with clients. It writes the error response and returns false when the body
+// can't be decoded or the selector is invalid (400), the caller can't list a selected kind (403) or listing the
+// workloads fails (500).
+func decodeResourceRequests[R any, S selectorRequest[R]](ctx context.Context, w http.ResponseWriter, logger zap.SugaredLogger, clients api.Clients, body []byte) ([]R, bool) {
+	var resources []R
+	var selector S
+	var err error
+	if isSelectorRequest(body) {
+		err = json.Unmarshal(body, &selector)
+	} else {
+		err = json.Unmarshal(body, &resources)
+	}
+	if err != nil {
+		logger.Error(api.ErrorDecodeJSON, err)
+		http.Error(w, api.ErrorDecodeJSON+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if !isSelectorRequest(body) {
+		return resources, true
+	}
+	resources, err = selector.resources(ctx, clients)
+	if errors.Is(err, errInvalidSelector) {
+		logger.Error(api.ErrorInvalidInput, err)
+		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if apierrors.IsForbidden(err) {
+		logger.Error(api.ErrorForbidden, err)
+		http.Error(w, api.ErrorForbidden+err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		logger.Error(api.ErrorList, err)
+		http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return resources, true
+}
+
+// validate checks the selector fields before any workload is listed
+func (selector WorkloadSelector) validate() error {
+	if selector.Namespace == "" {
+		return fmt.Errorf("%w: namespace is required", errInvalidSelector)
+	}
+	if _, err := labels.Parse(selector.LabelSelector); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSelector, err)
+	}
+	for _, kind := range selector.Kinds {
+		if !api.IsValidKind(kind) {
+			return fmt.Errorf("%w: unsupported kind %q", errInvalidSelector, kind)
+		}
+	}
+	return nil
+}
+
+// selectWorkloads lists the workloads matching the selector, skipping ezkonnect's own workloads.
+// The caller must be allowed to list every selected kind in the namespace, it returns a Forbidden API error otherwise.
+func selectWorkloads(ctx context.Context, clients api.Clients, selector WorkloadSelector) ([]selectedWorkload, error) {
+	if err := selector.validate(); err != nil {
+		return nil, err
+	}
+	kinds := selector.Kinds
+	if len(kinds) == 0 {
+		kinds = DefaultSelectorKinds
+	}
+	var workloads []selectedWorkload
+	for _, kind := range kinds {
+		kind = strings.ToLower(kind)
+		if err := authorizeList(ctx, kind, selector.Namespace); err != nil {
+			return nil, err
+		}
+		names, err := api.ListWorkloads(ctx, clients, kind, selector.Namespace, selector.LabelSelector)
+		if errors.Is(err, api.ErrLabelSelectionUnsupported) {
+			return nil, fmt.Errorf("%w: %v", errInvalidSelector, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if api.IsInternalResource(name) {
+				continue
+			}
+			workloads = append(workloads, selectedWorkload{kind: kind, name: name})
+		}
+	}
+	return workloads, nil
+}
+
+// authorizeList checks that the caller may list the workloads of a kind in a namespace, see auth.Authorize.
+// In impersonation mode Kubernetes authorizes the list itself.
+func authorizeList(ctx context.Context, kind string, namespace string) error {
+	if auth.ImpersonationEnabled() {
+		return nil
+	}
+	resource, err := api.WorkloadGroupResource(kind)
+	if err != nil {
+		return err
+	}
+	return auth.Authorize(ctx, authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "list",
+		Group:     resource.Group,
+		Resource:  resource.Resource,
+	})
+}
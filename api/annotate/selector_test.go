@@ -0,0 +1,120 @@
+package annotate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSelectWorkloadsAuthorization(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "shop"}},
+		&appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "db", Namespace: "shop"}},
+	)
+	// The caller may only list deployments
+	var reviews []authorizationv1.ResourceAttributes
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, *review.Spec.ResourceAttributes)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource == "deployments"
+		return true, review, nil
+	})
+	if err := auth.ConfigureAuthorization(auth.AuthorizationSubjectAccessReview, auth.ModeTokenReview, clientset); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auth.ConfigureAuthorization(auth.AuthorizationNone, auth.ModeNone, nil)
+	})
+	ctx := auth.WithUser(context.Background(), &auth.User{Name: "alice"})
+	clients := api.Clients{Kube: clientset}
+
+	workloads, err := selectWorkloads(ctx, clients, WorkloadSelector{Namespace: "shop", Kinds: []string{api.KindDeployment}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(workloads, []selectedWorkload{{kind: api.KindDeployment, name: "api"}}) {
+		t.Errorf("workloads = %+v, want the api deployment", workloads)
+	}
+	want := authorizationv1.ResourceAttributes{Namespace: "shop", Verb: "list", Group: "apps", Resource: "deployments"}
+	if len(reviews) != 1 || reviews[0] != want {
+		t.Errorf("reviews = %+v, want %+v", reviews, want)
+	}
+
+	// A kind the caller can't list fails the selection before anything is listed
+	clientset.ClearActions()
+	_, err = selectWorkloads(ctx, clients, WorkloadSelector{Namespace: "shop", Kinds: []string{api.KindStatefulSet, api.KindDeployment}})
+	if !apierrors.IsForbidden(err) {
+		t.Errorf("error = %v, want Forbidden", err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "list" {
+			t.Errorf("listed %s without permission", action.GetResource().Resource)
+		}
+	}
+}
+
+func TestDecodeResourceRequests(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "shop"}},
+	)
+	clientset.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		switch action.GetNamespace() {
+		case "restricted":
+			return true, nil, apierrors.NewForbidden(deploymentsGroupResource, "", errors.New("not allowed"))
+		case "unavailable":
+			return true, nil, apierrors.NewServiceUnavailable("unavailable")
+		}
+		return false, nil, nil
+	})
+	clients := api.Clients{Kube: clientset}
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		resources []TracesResourceRequest
+	}{
+		{
+			name:      "resources",
+			body:      `[{"name":"api","controller_kind":"deployment","namespace":"shop","action":"add"}]`,
+			status:    http.StatusOK,
+			resources: []TracesResourceRequest{{Name: "api", Kind: api.KindDeployment, Namespace: "shop", Action: api.ActionAdd}},
+		},
+		{
+			name:      "selector",
+			body:      ` {"namespace":"shop","kinds":["deployment"],"action":"add"}`,
+			status:    http.StatusOK,
+			resources: []TracesResourceRequest{{Name: "api", Kind: api.KindDeployment, Namespace: "shop", Action: api.ActionAdd}},
+		},
+		{name: "malformed resources", body: `[{"name":`, status: http.StatusBadRequest},
+		{name: "malformed selector", body: `{"namespace":1}`, status: http.StatusBadRequest},
+		{name: "invalid selector", body: `{"kinds":["deployment"],"action":"add"}`, status: http.StatusBadRequest},
+		{name: "invalid action", body: `{"namespace":"shop","action":"toggle"}`, status: http.StatusBadRequest},
+		{name: "forbidden", body: `{"namespace":"restricted","kinds":["deployment"],"action":"add"}`, status: http.StatusForbidden},
+		{name: "list error", body: `{"namespace":"unavailable","kinds":["deployment"],"action":"add"}`, status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			resources, ok := decodeResourceRequests[TracesResourceRequest, TracesSelectorRequest](context.Background(), recorder, api.InitLogger(), clients, []byte(test.body))
+			if ok != (test.status == http.StatusOK) || recorder.Code != test.status {
+				t.Fatalf("ok = %v, status = %d, want %d: %s", ok, recorder.Code, test.status, recorder.Body.String())
+			}
+			if !reflect.DeepEqual(resources, test.resources) {
+				t.Errorf("resources = %+v, want %+v", resources, test.resources)
+			}
+		})
+	}
+}
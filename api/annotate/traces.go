@@ -1,23 +1,25 @@
 package annotate
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"github.com/logzio/ezkonnect-server/api"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"github.com/logzio/ezkonnect-server/api/audit"
+	"github.com/logzio/ezkonnect-server/api/metrics"
+	"io"
 	"net/http"
 	"strings"
 )
 
 const (
-	InstrumentationAnnotation = "logz.io/traces_instrument"
-	ServiceNameAnnotation     = "logz.io/service-name"
+	InstrumentationAnnotation = api.InstrumentationAnnotation
+	ServiceNameAnnotation     = api.ServiceNameAnnotation
 )
 
 // TracesResourceRequest ResourceRequest is the JSON body of the POST request
 // It contains the name, kind, namespace, telemetry type and action of the resource
 // name: name of the resource
-// kind: kind of the resource (deployment or statefulset) consts defined at `common.go` (api.KindDeployment, api.KindStatefulSet)
+// kind: kind of the resource (deployment, statefulset, daemonset, cronjob, job or rollout) consts defined at `common.go` (api.KindDeployment, api.KindStatefulSet, api.KindDaemonSet, api.KindCronJob, api.KindJob, api.KindRollout)
 // namespace: namespace of the resource
 // action: action to perform (add or delete) consts defined at `common.go` (api.ActionAdd, api.ActionDelete)
 // service_name: name of the service
@@ -29,42 +31,65 @@ type TracesResourceRequest struct {
 	ServiceName string `json:"service_name"`
 }
 
-// TracesResourceResponse  is the JSON response of the POST request
-// It contains the name, kind, namespace and updated annotations of the resource
-// name: name of the resource
-// kind: kind of the resource (deployment or statefulset)
-// namespace: namespace of the resource
-// updated_annotations: updated annotations of the resource
-type TracesResourceResponse struct {
-	Name               string            `json:"name"`
-	Namespace          string            `json:"namespace"`
-	Kind               string            `json:"controller_kind"`
-	UpdatedAnnotations map[string]string `json:"updated_annotations"`
+// TracesSelectorRequest is the selector form of the JSON body of the POST request, it applies the action
+// to all the workloads matched by the selector, see WorkloadSelector
+// action: action to perform (add or delete)
+type TracesSelectorRequest struct {
+	WorkloadSelector
+	Action string `json:"action"`
+}
+
+// resources returns a request per workload matched by the selector
+func (selector TracesSelectorRequest) resources(ctx context.Context, clients api.Clients) ([]TracesResourceRequest, error) {
+	if selector.Action != api.ActionAdd && selector.Action != api.ActionDelete {
+		return nil, fmt.Errorf("%w: unsupported action %q", errInvalidSelector, selector.Action)
+	}
+	workloads, err := selectWorkloads(ctx, clients, selector.WorkloadSelector)
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]TracesResourceRequest, 0, len(workloads))
+	for _, workload := range workloads {
+		resources = append(resources, TracesResourceRequest{
+			Name:      workload.name,
+			Kind:      workload.kind,
+			Namespace: selector.Namespace,
+			Action:    selector.Action,
+		})
+	}
+	return resources, nil
 }
 
+// TracesResourceResponse is the JSON response of the POST request, one per requested resource, see ResourceResult
+type TracesResourceResponse = ResourceResult
+
 func UpdateTracesResourceAnnotations(w http.ResponseWriter, r *http.Request) {
 	logger := api.InitLogger()
-	// Decode JSON body
-	var resources []TracesResourceRequest
-	err := json.NewDecoder(r.Body).Decode(&resources)
+	options, err := parseAnnotateOptions(r.URL.Query())
 	if err != nil {
-		logger.Error(api.ErrorDecodeJSON, err)
-		http.Error(w, api.ErrorDecodeJSON+err.Error(), http.StatusBadRequest)
+		logger.Error(api.ErrorInvalidInput, err)
+		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Get the Kubernetes config
-	config, err := api.GetConfig()
+	// Read the JSON body, either an array of resources or a selector, see decodeResourceRequests
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.Error(api.ErrorKubeConfig, err)
-		http.Error(w, api.ErrorKubeConfig+err.Error(), http.StatusInternalServerError)
+		logger.Error(api.ErrorDecodeJSON, err)
+		http.Error(w, api.ErrorDecodeJSON+err.Error(), http.StatusBadRequest)
 		return
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	// Get the Kubernetes clients, impersonating the caller in impersonation mode
+	clients, err := api.GetRequestClients(r.Context())
 	if err != nil {
 		logger.Error(api.ErrorKubeClient, err)
 		http.Error(w, api.ErrorKubeClient+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// Decode the body, listing the workloads of a selector
+	resources, ok := decodeResourceRequests[TracesResourceRequest, TracesSelectorRequest](r.Context(), w, logger, clients, body)
+	if !ok {
+		return
+	}
 
 	// Validate input before updating resources to avoid changing resources and retuning an error
 	// if one of the requests is invalid, return an error
@@ -74,84 +99,47 @@ func UpdateTracesResourceAnnotations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var responses []TracesResourceResponse
+	changes := make([]annotationChange, 0, len(resources))
 	for _, resource := range resources {
-		// choose the annotation key and value according to the telemetry type and action
-		actionValue := "true"
-		if resource.Action == api.ActionDelete {
-			actionValue = "rollback"
-		}
-		annotations := map[string]string{}
-		annotations[InstrumentationAnnotation] = actionValue
-		// add service name annotation if exists
-		if resource.ServiceName != "" {
-			annotations[ServiceNameAnnotation] = resource.ServiceName
-		}
-
-		// Create the response
-		response := TracesResourceResponse{
-			Name:               resource.Name,
-			Namespace:          resource.Namespace,
-			Kind:               resource.Kind,
-			UpdatedAnnotations: annotations,
-		}
-
-		switch resource.Kind {
-		case api.KindDeployment:
-			logger.Info("Updating deployment: ", resource.Name)
-			deployment, err := clientset.AppsV1().Deployments(resource.Namespace).Get(r.Context(), resource.Name, v1.GetOptions{})
-			if err != nil {
-				logger.Error(api.ErrorGet, err)
-				http.Error(w, api.ErrorGet+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			for k, v := range annotations {
-				if deployment.Spec.Template.ObjectMeta.Annotations == nil {
-					deployment.Spec.Template.ObjectMeta.Annotations = make(map[string]string)
-				}
-				deployment.Spec.Template.ObjectMeta.Annotations[k] = v
-			}
-
-			_, err = clientset.AppsV1().Deployments(resource.Namespace).Update(r.Context(), deployment, v1.UpdateOptions{})
-			if err != nil {
-				logger.Error(api.ErrorUpdate, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			responses = append(responses, response)
+		changes = append(changes, tracesAnnotationChange(resource))
+	}
 
-		case api.KindStatefulSet:
-			logger.Info("Updating statefulset: ", resource.Name)
-			statefulSet, err := clientset.AppsV1().StatefulSets(resource.Namespace).Get(r.Context(), resource.Name, v1.GetOptions{})
-			if err != nil {
-				logger.Error(api.ErrorGet, err)
-				http.Error(w, api.ErrorGet+err.Error(), http.StatusInternalServerError)
-				return
-			}
+	responses, failed := annotateResources(r.Context(), logger, clients, changes, options)
+	writeResults(w, responses, failed)
+}
 
+// tracesAnnotationChange builds the pod template annotations change of a traces request
+func tracesAnnotationChange(resource TracesResourceRequest) annotationChange {
+	// choose the annotation key and value according to the telemetry type and action
+	actionValue := "true"
+	if resource.Action == api.ActionDelete {
+		actionValue = "rollback"
+	}
+	annotations := map[string]string{}
+	annotations[InstrumentationAnnotation] = actionValue
+	// add service name annotation if exists
+	if resource.ServiceName != "" {
+		annotations[ServiceNameAnnotation] = resource.ServiceName
+	}
+	outcome := metrics.OutcomeAdded
+	if resource.Action == api.ActionDelete {
+		outcome = metrics.OutcomeRolledBack
+	}
+	return annotationChange{
+		name:        resource.Name,
+		kind:        resource.Kind,
+		namespace:   resource.Namespace,
+		annotations: annotations,
+		mutate: func(current map[string]string) {
 			for k, v := range annotations {
-				if statefulSet.Spec.Template.ObjectMeta.Annotations == nil {
-					statefulSet.Spec.Template.ObjectMeta.Annotations = make(map[string]string)
-				}
-				statefulSet.Spec.Template.ObjectMeta.Annotations[k] = v
+				current[k] = v
 			}
-
-			_, err = clientset.AppsV1().StatefulSets(resource.Namespace).Update(r.Context(), statefulSet, v1.UpdateOptions{})
-			if err != nil {
-				logger.Error(api.ErrorUpdate, err)
-				http.Error(w, api.ErrorUpdate+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			responses = append(responses, response)
-		}
+		},
+		outcome:     outcome,
+		operation:   audit.OperationTraces,
+		action:      resource.Action,
+		serviceName: resource.ServiceName,
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(responses)
 }
 
 func validateTracesResourceRequests(resources []TracesResourceRequest) bool {
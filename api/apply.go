@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"strings"
+)
+
+// FieldManager is the field manager ezkonnect records in the managedFields of the workloads it annotates
+const FieldManager = "ezkonnect-server"
+
+// FieldManagerConflict is a field owned by another field manager that a server-side apply tried to change
+// manager: name of the field manager that owns the field
+// field: path of the conflicting field
+type FieldManagerConflict struct {
+	Manager string `json:"manager"`
+	Field   string `json:"field"`
+}
+
+// ApplyPodTemplateAnnotations fetches a workload, applies mutate to its pod template annotations and
+// server-side applies the annotations it changed with opts.FieldManager, so other field managers
+// such as GitOps controllers see ezkonnect as the owner of these annotations.
+// The apply configuration also keeps the annotations opts.FieldManager already owns, since an apply deletes
+// the owned fields it omits, and leaves the unchanged annotations of other managers alone.
+// Changing an annotation owned by another manager fails with a conflict unless opts.Force is set.
+// Annotations removed by mutate are deleted with a merge patch, since an apply only removes the fields owned by its manager.
+// Nothing is sent when mutate doesn't change the annotations. It returns the annotations before and after the mutation
+// and whether the change triggers a rollout.
+func ApplyPodTemplateAnnotations(ctx context.Context, clients Clients, kind string, namespace string, name string, mutate func(annotations map[string]string), opts v1.PatchOptions) (PodTemplateChange, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return PodTemplateChange{}, fmt.Errorf("unsupported kind %q", kind)
+	}
+	object, err := accessor.Get(ctx, clients, namespace, name)
+	if err != nil {
+		return PodTemplateChange{}, err
+	}
+	change := newPodTemplateChange(accessor, object, mutate)
+	if !change.Changed() {
+		return change, nil
+	}
+	before, after := change.Before, change.After
+
+	owned, err := ownedAnnotations(object, opts.FieldManager, accessor.AnnotationsPath())
+	if err != nil {
+		return PodTemplateChange{}, err
+	}
+	applied := map[string]interface{}{}
+	for key, value := range after {
+		if previous, ok := before[key]; !ok || previous != value || owned[key] {
+			applied[key] = value
+		}
+	}
+	// An apply without fields only matters when it gives up fields the manager owned
+	if len(applied) > 0 || len(owned) > 0 {
+		patch, err := annotationsApplyPatch(object, accessor.AnnotationsPath(), applied)
+		if err != nil {
+			return PodTemplateChange{}, err
+		}
+		err = accessor.Patch(ctx, clients, namespace, name, types.ApplyPatchType, patch, opts)
+		if err != nil {
+			return PodTemplateChange{}, err
+		}
+	}
+
+	removed := false
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = true
+		}
+	}
+	if removed {
+		patch, err := annotationsMergePatch(accessor.AnnotationsPath(), "", before, after)
+		if err != nil {
+			return PodTemplateChange{}, err
+		}
+		err = accessor.Patch(ctx, clients, namespace, name, types.MergePatchType, patch, v1.PatchOptions{DryRun: opts.DryRun, FieldManager: opts.FieldManager})
+		if err != nil {
+			return PodTemplateChange{}, err
+		}
+	}
+	return change, nil
+}
+
+// ownedAnnotations returns the annotation keys under annotationsPath that fieldManager owns through a server-side apply,
+// according to the managedFields of object
+func ownedAnnotations(object runtime.Object, fieldManager string, annotationsPath []string) (map[string]bool, error) {
+	metadata, err := meta.Accessor(object)
+	if err != nil {
+		return nil, err
+	}
+	owned := map[string]bool{}
+	for _, entry := range metadata.GetManagedFields() {
+		if entry.Manager != fieldManager || entry.Operation != v1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			return nil, fmt.Errorf("decoding the managed fields of %s: %w", fieldManager, err)
+		}
+		// managedFields prefix the field names with "f:", for example {"f:spec":{"f:template":{...}}}
+		for _, field := range annotationsPath {
+			fields, _ = fields["f:"+field].(map[string]interface{})
+		}
+		for field := range fields {
+			if key := strings.TrimPrefix(field, "f:"); key != field {
+				owned[key] = true
+			}
+		}
+	}
+	return owned, nil
+}
+
+// annotationsApplyPatch builds a server-side apply configuration of object that only sets the given pod template annotations
+func annotationsApplyPatch(object runtime.Object, annotationsPath []string, annotations map[string]interface{}) ([]byte, error) {
+	gvk := object.GetObjectKind().GroupVersionKind()
+	// Objects read with the typed clientset don't carry their type, look it up in the scheme
+	if gvk.Empty() {
+		kinds, _, err := scheme.Scheme.ObjectKinds(object)
+		if err != nil {
+			return nil, err
+		}
+		gvk = kinds[0]
+	}
+	metadata, err := meta.Accessor(object)
+	if err != nil {
+		return nil, err
+	}
+	var patch interface{} = annotations
+	for i := len(annotationsPath) - 1; i >= 0; i-- {
+		patch = map[string]interface{}{annotationsPath[i]: patch}
+	}
+	configuration := patch.(map[string]interface{})
+	configuration["apiVersion"] = gvk.GroupVersion().String()
+	configuration["kind"] = gvk.Kind
+	configuration["metadata"] = map[string]interface{}{
+		"name":      metadata.GetName(),
+		"namespace": metadata.GetNamespace(),
+	}
+	return json.Marshal(configuration)
+}
+
+// FieldManagerConflicts returns the fields owned by other field managers that caused a server-side apply to fail,
+// or nil when err is not an apply conflict
+func FieldManagerConflicts(err error) []FieldManagerConflict {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok || !apierrors.IsConflict(err) || status.Status().Details == nil {
+		return nil
+	}
+	var conflicts []FieldManagerConflict
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != v1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		// The message has the form: conflict with "<manager>"[ using <apiVersion>]
+		manager := cause.Message
+		if parts := strings.Split(cause.Message, `"`); len(parts) >= 3 {
+			manager = parts[1]
+		}
+		conflicts = append(conflicts, FieldManagerConflict{Manager: manager, Field: cause.Field})
+	}
+	return conflicts
+}
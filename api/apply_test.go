@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// managedAnnotationsFields returns the managedFields entry of a manager that applied the given pod template annotations
+func managedAnnotationsFields(manager string, keys ...string) v1.ManagedFieldsEntry {
+	annotations := ""
+	for i, key := range keys {
+		if i > 0 {
+			annotations += ","
+		}
+		annotations += `"f:` + key + `":{}`
+	}
+	return v1.ManagedFieldsEntry{
+		Manager:   manager,
+		Operation: v1.ManagedFieldsOperationApply,
+		FieldsV1:  &v1.FieldsV1{Raw: []byte(`{"f:spec":{"f:template":{"f:metadata":{"f:annotations":{` + annotations + `}}}}}`)},
+	}
+}
+
+func TestApplyPodTemplateAnnotations(t *testing.T) {
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		managedFields []v1.ManagedFieldsEntry
+		mutate        func(annotations map[string]string)
+		// expected patches in order
+		patches []string
+	}{
+		{
+			name:        "changed keys only",
+			annotations: map[string]string{LogTypeAnnotation: "nginx", ServiceNameAnnotation: "cart"},
+			managedFields: []v1.ManagedFieldsEntry{
+				managedAnnotationsFields("argocd-controller", LogTypeAnnotation, ServiceNameAnnotation),
+			},
+			mutate: func(annotations map[string]string) {
+				annotations[InstrumentationAnnotation] = "true"
+			},
+			patches: []string{
+				`apply {"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"api","namespace":"default"},"spec":{"template":{"metadata":{"annotations":{"logz.io/traces_instrument":"true"}}}}}`,
+			},
+		},
+		{
+			name:        "keeps owned keys",
+			annotations: map[string]string{InstrumentationAnnotation: "true", ServiceNameAnnotation: "cart", LogTypeAnnotation: "nginx"},
+			managedFields: []v1.ManagedFieldsEntry{
+				managedAnnotationsFields(FieldManager, InstrumentationAnnotation, ServiceNameAnnotation),
+				managedAnnotationsFields("argocd-controller", LogTypeAnnotation),
+			},
+			mutate: func(annotations map[string]string) {
+				annotations[ServiceNameAnnotation] = "checkout"
+			},
+			patches: []string{
+				`apply {"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"api","namespace":"default"},"spec":{"template":{"metadata":{"annotations":{"logz.io/service-name":"checkout","logz.io/traces_instrument":"true"}}}}}`,
+			},
+		},
+		{
+			name:        "removal without owned keys",
+			annotations: map[string]string{LogTypeAnnotation: "nginx"},
+			managedFields: []v1.ManagedFieldsEntry{
+				managedAnnotationsFields("argocd-controller", LogTypeAnnotation),
+			},
+			mutate: func(annotations map[string]string) {
+				delete(annotations, LogTypeAnnotation)
+			},
+			patches: []string{
+				`merge {"spec":{"template":{"metadata":{"annotations":{"logz.io/application_type":null}}}}}`,
+			},
+		},
+		{
+			name:        "removal of owned keys",
+			annotations: map[string]string{InstrumentationAnnotation: "true", ServiceNameAnnotation: "cart"},
+			managedFields: []v1.ManagedFieldsEntry{
+				managedAnnotationsFields(FieldManager, InstrumentationAnnotation, ServiceNameAnnotation),
+			},
+			mutate: func(annotations map[string]string) {
+				delete(annotations, ServiceNameAnnotation)
+			},
+			patches: []string{
+				`apply {"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"api","namespace":"default"},"spec":{"template":{"metadata":{"annotations":{"logz.io/traces_instrument":"true"}}}}}`,
+				`merge {"spec":{"template":{"metadata":{"annotations":{"logz.io/service-name":null}}}}}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+				ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "default", ManagedFields: test.managedFields},
+				Spec:       deploymentSpec(test.annotations),
+			})
+			var patches []string
+			// The fake clientset can't server-side apply, record the patches instead
+			clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patch := action.(k8stesting.PatchAction)
+				prefix := "merge "
+				if patch.GetPatchType() == types.ApplyPatchType {
+					prefix = "apply "
+				}
+				patches = append(patches, prefix+string(patch.GetPatch()))
+				return true, &appsv1.Deployment{}, nil
+			})
+			_, err := ApplyPodTemplateAnnotations(context.Background(), Clients{Kube: clientset}, KindDeployment, "default", "api", test.mutate, v1.PatchOptions{FieldManager: FieldManager})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(patches, test.patches) {
+				t.Errorf("patches = %q, want %q", patches, test.patches)
+			}
+		})
+	}
+}
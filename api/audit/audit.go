@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit sinks, see Configure
+const (
+	// SinkLog writes the entries to the structured log stream
+	SinkLog = "log"
+	// SinkFile appends the entries to a local JSON-lines file
+	SinkFile = "file"
+	// SinkEvent emits a Kubernetes Event on the workload of every change, see eventSink
+	SinkEvent = "event"
+)
+
+// Annotate operations recorded in the audit trail
+const (
+	OperationTraces = "traces"
+	OperationLogs   = "logs"
+	// OperationRollback restores a resource after a failed atomic request
+	OperationRollback = "rollback"
+)
+
+// memoryCapacity is the number of entries kept in memory when no audit file is configured
+const memoryCapacity = 1000
+
+// Entry is the audit record of an annotate operation on a single workload
+// time: when the operation completed
+// request_id: the id of the request, see RequestMiddleware
+// user: the authenticated caller, omitted when authentication is disabled
+// groups: the groups of the caller
+// source_ip: the address the request came from
+// operation: traces, logs or rollback
+// action: add or delete, the traces action or whether the log type was set or removed, omitted for rollbacks
+// service_name: the requested service name of traces operations, omitted when not set
+// log_type: the requested log type of logs operations, omitted when removed
+// controller_kind, namespace, name: the changed workload
+// before: the pod template annotations before the operation
+// after: the pod template annotations after the operation
+// outcome: the metrics outcome of the operation, for example added, log_type_set, unchanged or failed
+// error: the reason of the failure, only set for failed operations
+type Entry struct {
+	Time        time.Time         `json:"time"`
+	RequestID   string            `json:"request_id"`
+	User        string            `json:"user,omitempty"`
+	Groups      []string          `json:"groups,omitempty"`
+	SourceIP    string            `json:"source_ip"`
+	Operation   string            `json:"operation"`
+	Action      string            `json:"action,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	LogType     string            `json:"log_type,omitempty"`
+	Kind        string            `json:"controller_kind"`
+	Namespace   string            `json:"namespace"`
+	Name        string            `json:"name"`
+	Before      map[string]string `json:"before,omitempty"`
+	After       map[string]string `json:"after,omitempty"`
+	Outcome     string            `json:"outcome"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// Sink records audit entries
+type Sink interface {
+	Record(ctx context.Context, entry Entry) error
+}
+
+// Store is a Sink whose entries can be read back, it serves GET /api/v1/audit
+type Store interface {
+	Sink
+	// Query returns the entries matching the filter, most recent first
+	Query(ctx context.Context, filter Filter) ([]Entry, error)
+}
+
+// trail is the configured audit trail, see Configure. The entries are only kept in memory until it is configured.
+var trail = newTrail()
+
+type auditTrail struct {
+	sync.RWMutex
+	sinks []Sink
+	store Store
+	close []func()
+}
+
+func newTrail() *auditTrail {
+	memory := newMemoryStore(memoryCapacity)
+	return &auditTrail{sinks: []Sink{memory}, store: memory}
+}
+
+// Configure sets the audit sinks from a comma separated list of SinkLog, SinkFile and SinkEvent.
+// The file sink appends to filePath and serves the queries, the entries are otherwise kept in memory and lost
+// on restart. The event sink records the Events with clientset. It is called once before the server starts.
+func Configure(sinks string, filePath string, clientset kubernetes.Interface) error {
+	var configured []Sink
+	var store Store
+	var closers []func()
+	for _, name := range strings.Split(sinks, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case SinkLog:
+			configured = append(configured, newLogSink())
+		case SinkFile:
+			if filePath == "" {
+				return fmt.Errorf("audit sink %q requires an audit file", SinkFile)
+			}
+			file, err := NewFileStore(filePath)
+			if err != nil {
+				return err
+			}
+			configured = append(configured, file)
+			store = file
+			closers = append(closers, func() { file.Close() })
+		case SinkEvent:
+			event := newEventSink(clientset)
+			configured = append(configured, event)
+			closers = append(closers, event.Shutdown)
+		default:
+			return fmt.Errorf("unsupported audit sink %q", name)
+		}
+	}
+	if store == nil {
+		memory := newMemoryStore(memoryCapacity)
+		configured, store = append(configured, memory), memory
+	}
+	trail.Lock()
+	defer trail.Unlock()
+	trail.sinks, trail.store, trail.close = configured, store, closers
+	return nil
+}
+
+// Shutdown flushes and closes the configured sinks
+func Shutdown() {
+	trail.Lock()
+	defer trail.Unlock()
+	for _, close := range trail.close {
+		close()
+	}
+	trail.close = nil
+}
+
+// Record completes the entry with the time and the caller of the request context, and records it to every sink.
+// A failing sink doesn't stop the others, the failures are logged.
+func Record(ctx context.Context, entry Entry) {
+	entry.Time = time.Now().UTC()
+	entry.RequestID = RequestIDFrom(ctx)
+	entry.SourceIP = SourceIPFrom(ctx)
+	if user, ok := auth.UserFrom(ctx); ok {
+		entry.User, entry.Groups = user.Name, user.Groups
+	}
+	trail.RLock()
+	sinks := trail.sinks
+	trail.RUnlock()
+	for _, sink := range sinks {
+		if err := sink.Record(ctx, entry); err != nil {
+			logger := api.InitLogger()
+			logger.Error(api.ErrorAudit, err)
+		}
+	}
+}
+
+// Query returns the recorded entries matching the filter, most recent first
+func Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	trail.RLock()
+	store := trail.store
+	trail.RUnlock()
+	return store.Query(ctx, filter)
+}
+
+// Filter selects audit entries, empty fields match every entry
+// limit: the maximum number of entries, the most recent ones are kept
+type Filter struct {
+	Namespace string
+	Kind      string
+	Name      string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// Matches reports whether an entry matches the filter
+func (filter Filter) Matches(entry Entry) bool {
+	if filter.Namespace != "" && entry.Namespace != filter.Namespace {
+		return false
+	}
+	if filter.Kind != "" && entry.Kind != filter.Kind {
+		return false
+	}
+	if filter.Name != "" && entry.Name != filter.Name {
+		return false
+	}
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// latest returns the entries of a chronological list matching the filter, most recent first
+func (filter Filter) latest(entries []Entry) []Entry {
+	matched := []Entry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(matched) == filter.Limit {
+			break
+		}
+		if filter.Matches(entries[i]) {
+			matched = append(matched, entries[i])
+		}
+	}
+	return matched
+}
@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+)
+
+// Reasons of the workload Events, see eventSink
+const (
+	EventReasonTracesInstrumented   = "TracesInstrumented"
+	EventReasonTracesUninstrumented = "TracesUninstrumented"
+	EventReasonLogTypeSet           = "LogTypeSet"
+	EventReasonLogTypeRemoved       = "LogTypeRemoved"
+	EventReasonAnnotationsReverted  = "AnnotationsReverted"
+	EventReasonAnnotateFailed       = "AnnotateFailed"
+	// eventComponent is the source component of the workload Events
+	eventComponent = "ezkonnect-server"
+)
+
+// eventReasons are the reasons of the successful changes by metrics outcome
+var eventReasons = map[string]string{
+	metrics.OutcomeAdded:          EventReasonTracesInstrumented,
+	metrics.OutcomeRolledBack:     EventReasonTracesUninstrumented,
+	metrics.OutcomeLogTypeSet:     EventReasonLogTypeSet,
+	metrics.OutcomeLogTypeRemoved: EventReasonLogTypeRemoved,
+	metrics.OutcomeReverted:       EventReasonAnnotationsReverted,
+}
+
+// eventSink emits a Kubernetes Event on the workload of every change, so `kubectl describe` shows what ezkonnect
+// changed and who requested it: Normal for successful changes and Warning for failed ones. Unchanged workloads
+// get no Event. The Events are sent in the background by an event broadcaster, which also aggregates repeated Events.
+type eventSink struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+}
+
+func newEventSink(clientset kubernetes.Interface) *eventSink {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return &eventSink{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+	}
+}
+
+// Record looks the workload up with the server's own clients, the caller may not be allowed to read it
+func (sink *eventSink) Record(ctx context.Context, entry Entry) error {
+	reason, ok := eventReasons[entry.Outcome]
+	if entry.Error == "" && !ok {
+		return nil
+	}
+	clients, err := api.GetClients()
+	if err != nil {
+		return err
+	}
+	reference, err := api.GetWorkloadReference(ctx, clients, entry.Kind, entry.Namespace, entry.Name)
+	if err != nil {
+		return fmt.Errorf("getting the event object: %w", err)
+	}
+	if entry.Error != "" {
+		sink.recorder.Eventf(reference, corev1.EventTypeWarning, EventReasonAnnotateFailed,
+			"Failed to %s, requested by %s: %s", describeChange(entry), requester(entry), entry.Error)
+		return nil
+	}
+	sink.recorder.Eventf(reference, corev1.EventTypeNormal, reason,
+		"Changed by ezkonnect to %s, requested by %s", describeChange(entry), requester(entry))
+	return nil
+}
+
+// Shutdown stops the broadcaster once the queued Events are sent
+func (sink *eventSink) Shutdown() {
+	sink.broadcaster.Shutdown()
+}
+
+// describeChange describes the requested change of an entry, for example `add traces instrumentation with service name "cart"`
+func describeChange(entry Entry) string {
+	switch {
+	case entry.Operation == OperationTraces && entry.Action == api.ActionDelete:
+		return "remove traces instrumentation"
+	case entry.Operation == OperationTraces && entry.ServiceName != "":
+		return fmt.Sprintf("add traces instrumentation with service name %q", entry.ServiceName)
+	case entry.Operation == OperationTraces:
+		return "add traces instrumentation"
+	case entry.Operation == OperationLogs && entry.Action == api.ActionDelete:
+		return "remove the log type"
+	case entry.Operation == OperationLogs:
+		return fmt.Sprintf("set the log type to %q", entry.LogType)
+	default:
+		return "restore the annotations after a failed atomic request"
+	}
+}
+
+// requester identifies the caller of an entry by user name, or by source IP when authentication is disabled
+func requester(entry Entry) string {
+	var parts []string
+	if entry.User != "" {
+		parts = append(parts, entry.User)
+	} else {
+		parts = append(parts, "anonymous")
+	}
+	if entry.SourceIP != "" {
+		parts = append(parts, "from "+entry.SourceIP)
+	}
+	if entry.RequestID != "" {
+		parts = append(parts, "(request "+entry.RequestID+")")
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/state"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QueryNamespace = "namespace"
+	QueryKind      = "controller_kind"
+	QueryName      = "name"
+	QuerySince     = "since"
+	QueryUntil     = "until"
+	QueryLimit     = "limit"
+	// defaultLimit is the number of entries returned when the request sets no limit
+	defaultLimit = 100
+)
+
+// GetAuditEntriesHandler returns the audit entries matching the query filters, most recent first.
+// When authorization is enabled, the entries of namespaces the caller cannot read the state of are left out.
+func GetAuditEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := api.InitLogger()
+	defer logger.Sync()
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		logger.Error(api.ErrorInvalidInput, zap.Error(err))
+		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The limit is applied after leaving out the entries the caller may not read
+	limit := filter.Limit
+	filter.Limit = 0
+	entries, err := Query(r.Context(), filter)
+	if err != nil {
+		logger.Error(api.ErrorAuditQuery, zap.Error(err))
+		http.Error(w, api.ErrorAuditQuery+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	allows := state.NamespaceFilter(r.Context())
+	allowed := entries[:0]
+	for _, entry := range entries {
+		if len(allowed) == limit {
+			break
+		}
+		ok, err := allows(entry.Namespace)
+		if err != nil {
+			logger.Error(api.ErrorForbidden, zap.Error(err))
+			http.Error(w, api.ErrorForbidden+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			allowed = append(allowed, entry)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(allowed); err != nil {
+		logger.Error(api.ErrorEncodeJSON, zap.Error(err))
+	}
+}
+
+// parseFilter builds a Filter from the request query, returning an error for malformed values.
+// since and until are RFC 3339 timestamps.
+func parseFilter(query url.Values) (Filter, error) {
+	filter := Filter{
+		Namespace: query.Get(QueryNamespace),
+		Kind:      strings.ToLower(query.Get(QueryKind)),
+		Name:      query.Get(QueryName),
+		Limit:     defaultLimit,
+	}
+	times := []struct {
+		query string
+		value *time.Time
+	}{
+		{QuerySince, &filter.Since},
+		{QueryUntil, &filter.Until},
+	}
+	for _, t := range times {
+		if value := query.Get(t.query); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %v", t.query, err)
+			}
+			*t.value = parsed
+		}
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && filter.Until.Before(filter.Since) {
+		return filter, fmt.Errorf("invalid %s: before %s", QueryUntil, QuerySince)
+	}
+	if value := query.Get(QueryLimit); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("invalid %s: must be a positive integer", QueryLimit)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"context"
+	"github.com/logzio/ezkonnect-server/api"
+	"go.uber.org/zap"
+)
+
+// logSink writes the entries to the structured log stream
+type logSink struct {
+	logger zap.SugaredLogger
+}
+
+func newLogSink() logSink {
+	return logSink{logger: api.InitLogger()}
+}
+
+func (sink logSink) Record(ctx context.Context, entry Entry) error {
+	sink.logger.Infow("Audit",
+		"time", entry.Time,
+		"request_id", entry.RequestID,
+		"user", entry.User,
+		"groups", entry.Groups,
+		"source_ip", entry.SourceIP,
+		"operation", entry.Operation,
+		"action", entry.Action,
+		"service_name", entry.ServiceName,
+		"log_type", entry.LogType,
+		"controller_kind", entry.Kind,
+		"namespace", entry.Namespace,
+		"name", entry.Name,
+		"before", entry.Before,
+		"after", entry.After,
+		"outcome", entry.Outcome,
+		"error", entry.Error,
+	)
+	return nil
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// RequestIDHeader carries the request id, a valid id sent by the client is kept so requests can be traced across services
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of the request ids accepted from clients
+const maxRequestIDLength = 128
+
+// requestInfo is the request metadata recorded in the audit entries
+type requestInfo struct {
+	id       string
+	sourceIP string
+}
+
+// requestContextKey is the context key of the request metadata
+type requestContextKey struct{}
+
+// RequestMiddleware assigns an id to every request, returned in the RequestIDHeader response header,
+// and stores it with the source IP of the request in the request context, see RequestIDFrom and SourceIPFrom
+func RequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+		sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			sourceIP = r.RemoteAddr
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestContextKey{}, requestInfo{id: id, sourceIP: sourceIP})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFrom returns the id of a request context, or an empty string outside RequestMiddleware
+func RequestIDFrom(ctx context.Context) string {
+	info, _ := ctx.Value(requestContextKey{}).(requestInfo)
+	return info.id
+}
+
+// SourceIPFrom returns the source IP of a request context, or an empty string outside RequestMiddleware
+func SourceIPFrom(ctx context.Context) string {
+	info, _ := ctx.Value(requestContextKey{}).(requestInfo)
+	return info.sourceIP
+}
+
+// isValidRequestID accepts non-empty ids of printable ASCII characters, so they are safe to log and echo back
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit id
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// maxLineSize bounds the size of a single entry read back from the audit file
+const maxLineSize = 1024 * 1024
+
+// FileStore appends the audit entries to a JSON-lines file, one entry per line.
+// The file is never truncated, rotate it with an external tool that copies and truncates it.
+// mutex serializes the writes, the queries read the file from a separate handle.
+type FileStore struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// NewFileStore opens the audit file for appending, creating it if needed
+func NewFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %w", err)
+	}
+	return &FileStore{path: path, file: file}, nil
+}
+
+// Record appends the entry and syncs the file, so recorded entries survive a crash
+func (store *FileStore) Record(ctx context.Context, entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, err := store.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return store.file.Sync()
+}
+
+// Query reads the whole file from its own handle, without blocking Record. Lines that can't be decoded are skipped,
+// such as a line that is being appended while the file is read.
+func (store *FileStore) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	file, err := os.Open(store.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filter.latest(entries), nil
+}
+
+// Close closes the file
+func (store *FileStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.file.Close()
+}
+
+// memoryStore keeps the last entries in a ring buffer
+type memoryStore struct {
+	mutex    sync.Mutex
+	entries  []Entry
+	next     int
+	capacity int
+}
+
+func newMemoryStore(capacity int) *memoryStore {
+	return &memoryStore{capacity: capacity}
+}
+
+func (store *memoryStore) Record(ctx context.Context, entry Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if len(store.entries) < store.capacity {
+		store.entries = append(store.entries, entry)
+		return nil
+	}
+	store.entries[store.next] = entry
+	store.next = (store.next + 1) % store.capacity
+	return nil
+}
+
+func (store *memoryStore) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// The oldest entry is at next once the buffer is full
+	entries := append(append([]Entry{}, store.entries[store.next:]...), store.entries[:store.next]...)
+	return filter.latest(entries), nil
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	entries := []Entry{
+		{Operation: OperationTraces, Kind: "deployment", Namespace: "shop", Name: "api", Outcome: "added"},
+		{Operation: OperationLogs, Kind: "deployment", Namespace: "shop", Name: "api", Outcome: "log_type_set"},
+		{Operation: OperationTraces, Kind: "statefulset", Namespace: "db", Name: "postgres", Outcome: "added"},
+	}
+	for _, entry := range entries {
+		if err := store.Record(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A line that is still being appended is skipped
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"operation":"traces","namespace":"shop"`)
+	file.Close()
+
+	got, err := store.Query(ctx, Filter{Namespace: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Entry{entries[1], entries[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %+v, want %+v", got, want)
+	}
+	got, _ = store.Query(ctx, Filter{Limit: 1})
+	if want := []Entry{entries[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("limited entries = %+v, want %+v", got, want)
+	}
+}
+
+func TestFileStoreQueryDoesNotBlockRecord(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	store.Record(ctx, Entry{Namespace: "shop", Name: "api"})
+
+	// Hold the write lock as a slow Record would
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	done := make(chan []Entry, 1)
+	go func() {
+		entries, _ := store.Query(ctx, Filter{})
+		done <- entries
+	}()
+	select {
+	case entries := <-done:
+		if len(entries) != 1 {
+			t.Errorf("entries = %+v, want the recorded entry", entries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query waited for the write lock")
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/logzio/ezkonnect-server/api"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"strings"
+)
+
+// Authentication modes, see New
+const (
+	// ModeNone serves every request without authentication
+	ModeNone = "none"
+	// ModeTokenReview validates bearer tokens with the Kubernetes TokenReview API
+	ModeTokenReview = "tokenreview"
+	// ModeStatic validates bearer tokens against a static token file, for local use
+	ModeStatic = "static"
+)
+
+// ErrUnauthenticated is returned by an Authenticator for missing, invalid or expired credentials
+var ErrUnauthenticated = errors.New("invalid bearer token")
+
+// PublicPaths are served without authentication, probes and metrics scrapers don't send credentials
+var PublicPaths = []string{"/healthz", "/readyz", "/metrics"}
+
+// User is the authenticated caller of a request
+// name: the username
+// uid: the unique id of the user, may be empty
+// groups: the groups the user belongs to
+// extra: additional information provided by the authenticator
+type User struct {
+	Name   string              `json:"name"`
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+// Authenticator resolves a bearer token to its user
+type Authenticator interface {
+	// Authenticate returns the user of the token, or ErrUnauthenticated when the token is not valid
+	Authenticate(ctx context.Context, token string) (*User, error)
+}
+
+// New returns the Authenticator of an authentication mode, or nil for ModeNone.
+// tokenFile is only used by ModeStatic and clientset only by ModeTokenReview.
+func New(mode string, tokenFile string, clientset kubernetes.Interface) (Authenticator, error) {
+	switch strings.ToLower(mode) {
+	case "", ModeNone:
+		return nil, nil
+	case ModeTokenReview:
+		return NewTokenReviewAuthenticator(clientset), nil
+	case ModeStatic:
+		return NewStaticTokenAuthenticator(tokenFile)
+	default:
+		return nil, fmt.Errorf("unsupported authentication mode %q", mode)
+	}
+}
+
+// userContextKey is the context key of the authenticated user
+type userContextKey struct{}
+
+// WithUser returns a copy of ctx that carries the authenticated user
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// UserFrom returns the authenticated user of a request context
+func UserFrom(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*User)
+	return user, ok && user != nil
+}
+
+// Middleware authenticates the bearer token of every request except PublicPaths, and stores the user in the
+// request context, see UserFrom. In impersonation mode the request's Kubernetes clients impersonate the user,
+// see api.GetRequestClients. Requests with missing or invalid credentials get 401 with a JSON error.
+// A nil authenticator serves every request without authentication.
+func Middleware(authenticator Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if authenticator == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range PublicPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			logger := api.InitLogger()
+			scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			token = strings.TrimSpace(token)
+			if !strings.EqualFold(scheme, "Bearer") || token == "" {
+				logger.Warnw(api.ErrorUnauthorized, "path", r.URL.Path, "error", "missing bearer token")
+				writeError(w, http.StatusUnauthorized, api.ErrorUnauthorized+"missing bearer token")
+				return
+			}
+			user, err := authenticator.Authenticate(r.Context(), token)
+			if errors.Is(err, ErrUnauthenticated) {
+				logger.Warnw(api.ErrorUnauthorized, "path", r.URL.Path, "error", err)
+				writeError(w, http.StatusUnauthorized, api.ErrorUnauthorized+err.Error())
+				return
+			}
+			if err != nil {
+				logger.Error(api.ErrorAuthentication, err)
+				writeError(w, http.StatusInternalServerError, api.ErrorAuthentication+err.Error())
+				return
+			}
+			ctx := WithUser(r.Context(), user)
+			if ImpersonationEnabled() {
+				ctx = api.WithImpersonation(ctx, impersonationConfig(user))
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// writeError writes a JSON error response, with a bearer challenge for 401 responses
+func writeError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ezkonnect-server"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
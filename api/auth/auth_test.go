@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// authenticatorFunc is an Authenticator function
+type authenticatorFunc func(ctx context.Context, token string) (*User, error)
+
+func (authenticate authenticatorFunc) Authenticate(ctx context.Context, token string) (*User, error) {
+	return authenticate(ctx, token)
+}
+
+// serve sends a request for path with the given Authorization header through the middleware, the handler
+// responds with the name of the authenticated user
+func serve(t *testing.T, authenticator Authenticator, path string, authorization string) *httptest.ResponseRecorder {
+	t.Helper()
+	handler := Middleware(authenticator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := UserFrom(r.Context()); ok {
+			w.Write([]byte(user.Name))
+		}
+	}))
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMiddleware(t *testing.T) {
+	var tokens []string
+	authenticator := authenticatorFunc(func(ctx context.Context, token string) (*User, error) {
+		tokens = append(tokens, token)
+		switch token {
+		case "alice-token":
+			return &User{Name: "alice"}, nil
+		case "broken":
+			return nil, errors.New("connection refused")
+		}
+		return nil, ErrUnauthenticated
+	})
+	type middlewareTest struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+		body          string
+	}
+	tests := []middlewareTest{
+		{"valid token", "/api/v1/state", "Bearer alice-token", http.StatusOK, "alice"},
+		{"case insensitive scheme", "/api/v1/state", "bearer  alice-token ", http.StatusOK, "alice"},
+		{"missing header", "/api/v1/state", "", http.StatusUnauthorized, ""},
+		{"basic credentials", "/api/v1/state", "Basic YWxpY2U6cGFzc3dvcmQ=", http.StatusUnauthorized, ""},
+		{"empty token", "/api/v1/state", "Bearer ", http.StatusUnauthorized, ""},
+		{"invalid token", "/api/v1/state", "Bearer mallory-token", http.StatusUnauthorized, ""},
+		{"authenticator error", "/api/v1/state", "Bearer broken", http.StatusInternalServerError, ""},
+	}
+	for _, path := range PublicPaths {
+		tests = append(tests, middlewareTest{"public " + path, path, "", http.StatusOK, ""})
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(t, authenticator, test.path, test.authorization)
+			if response.Code != test.status {
+				t.Fatalf("status = %d, want %d", response.Code, test.status)
+			}
+			if test.status == http.StatusOK {
+				if body := response.Body.String(); body != test.body {
+					t.Errorf("body = %q, want %q", body, test.body)
+				}
+				return
+			}
+			var body map[string]string
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body["error"] == "" {
+				t.Errorf("body = %q, want a JSON error", response.Body.String())
+			}
+			if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("content type = %q, want application/json", contentType)
+			}
+			challenge := response.Header().Get("WWW-Authenticate")
+			if test.status == http.StatusUnauthorized && !strings.HasPrefix(challenge, "Bearer ") {
+				t.Errorf("WWW-Authenticate = %q, want a bearer challenge", challenge)
+			}
+			if test.status != http.StatusUnauthorized && challenge != "" {
+				t.Errorf("WWW-Authenticate = %q, want no challenge", challenge)
+			}
+		})
+	}
+	// Requests without a bearer token and public paths don't reach the authenticator
+	if want := []string{"alice-token", "alice-token", "mallory-token", "broken"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("authenticated tokens = %q, want %q", tokens, want)
+	}
+}
+
+func TestMiddlewareWithoutAuthenticator(t *testing.T) {
+	if response := serve(t, nil, "/api/v1/state", ""); response.Code != http.StatusOK {
+		t.Errorf("status = %d, want every request to be served", response.Code)
+	}
+}
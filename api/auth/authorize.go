@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"strings"
+)
+
+// Authorization modes, see ConfigureAuthorization
+const (
+	// AuthorizationNone performs every request with the server's own permissions
+	AuthorizationNone = "none"
+	// AuthorizationSubjectAccessReview checks the caller's permissions with a SubjectAccessReview before acting on their behalf
+	AuthorizationSubjectAccessReview = "subjectaccessreview"
+	// AuthorizationImpersonate makes the Kubernetes calls of a request impersonating its caller,
+	// so Kubernetes RBAC authorizes them and its audit log attributes them to the caller
+	AuthorizationImpersonate = "impersonate"
+)
+
+var (
+	// accessReviewClientset reviews the callers' permissions, nil when access reviews are disabled
+	accessReviewClientset kubernetes.Interface
+	// impersonate is set in impersonation mode
+	impersonate bool
+)
+
+// ConfigureAuthorization sets how the callers' permissions are checked. It is called once before the server starts.
+// Authorization requires an authentication mode, since the permissions are checked for the authenticated user.
+func ConfigureAuthorization(mode string, authenticationMode string, clientset kubernetes.Interface) error {
+	mode = strings.ToLower(mode)
+	accessReviewClientset, impersonate = nil, false
+	switch mode {
+	case "", AuthorizationNone:
+		return nil
+	case AuthorizationSubjectAccessReview, AuthorizationImpersonate:
+	default:
+		return fmt.Errorf("unsupported authorization mode %q", mode)
+	}
+	if strings.ToLower(authenticationMode) == ModeNone || authenticationMode == "" {
+		return fmt.Errorf("authorization mode %q requires an authentication mode", mode)
+	}
+	// The reviews are also used in impersonation mode, to filter the state read from the server's cache
+	accessReviewClientset = clientset
+	impersonate = mode == AuthorizationImpersonate
+	return nil
+}
+
+// Authorize checks with a SubjectAccessReview that the authenticated user of ctx may perform the action described
+// by attributes. It returns a Forbidden API error when the user is not allowed, and nil when access reviews are
+// disabled or the request is not authenticated.
+func Authorize(ctx context.Context, attributes authorizationv1.ResourceAttributes) error {
+	user, ok := UserFrom(ctx)
+	if accessReviewClientset == nil || !ok {
+		return nil
+	}
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = v
+	}
+	review, err := accessReviewClientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Name,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: &attributes,
+		},
+	}, v1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	if review.Status.Allowed {
+		return nil
+	}
+	message := fmt.Sprintf("user %q cannot %s resource %q in API group %q", user.Name, attributes.Verb, attributes.Resource, attributes.Group)
+	if attributes.Namespace != "" {
+		message += fmt.Sprintf(" in the namespace %q", attributes.Namespace)
+	}
+	if review.Status.Reason != "" {
+		message += ": " + review.Status.Reason
+	}
+	return apierrors.NewForbidden(schema.GroupResource{Group: attributes.Group, Resource: attributes.Resource}, attributes.Name, fmt.Errorf("%s", message))
+}
+
+// ImpersonationEnabled reports whether the Kubernetes calls of authenticated requests impersonate their caller
+func ImpersonationEnabled() bool {
+	return impersonate
+}
+
+// impersonationConfig returns the impersonation config of a user
+func impersonationConfig(user *User) rest.ImpersonationConfig {
+	return rest.ImpersonationConfig{
+		UserName: user.Name,
+		UID:      user.UID,
+		Groups:   user.Groups,
+		Extra:    user.Extra,
+	}
+}
+
+// AuthorizationEnabled reports whether the callers' permissions are checked for the request context
+func AuthorizationEnabled(ctx context.Context) bool {
+	_, ok := UserFrom(ctx)
+	return accessReviewClientset != nil && ok
+}
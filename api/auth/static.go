@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// StaticTokenAuthenticator validates bearer tokens against a fixed set of tokens, it is meant for local use
+type StaticTokenAuthenticator struct {
+	tokens map[string]*User
+}
+
+// NewStaticTokenAuthenticator reads a token file in the format of the Kubernetes API server's static token file,
+// a CSV file with a `token,user,uid,"group1,group2"` line per token where the uid and groups are optional
+func NewStaticTokenAuthenticator(path string) (*StaticTokenAuthenticator, error) {
+	if path == "" {
+		return nil, fmt.Errorf("a token file is required in %s mode", ModeStatic)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	authenticator := &StaticTokenAuthenticator{tokens: map[string]*User{}}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading token file %s: %v", path, err)
+		}
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("reading token file %s: line %d: a token and a user are required", path, line)
+		}
+		user := &User{Name: record[1]}
+		if len(record) > 2 {
+			user.UID = record[2]
+		}
+		if len(record) > 3 && record[3] != "" {
+			for _, group := range strings.Split(record[3], ",") {
+				user.Groups = append(user.Groups, strings.TrimSpace(group))
+			}
+		}
+		authenticator.tokens[record[0]] = user
+	}
+	if len(authenticator.tokens) == 0 {
+		return nil, fmt.Errorf("token file %s has no tokens", path)
+	}
+	return authenticator, nil
+}
+
+func (authenticator *StaticTokenAuthenticator) Authenticate(ctx context.Context, token string) (*User, error) {
+	// Compare every token in constant time so the response time doesn't leak token prefixes
+	var match *User
+	for candidate, user := range authenticator.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			match = user
+		}
+	}
+	if match == nil {
+		return nil, ErrUnauthenticated
+	}
+	return match, nil
+}
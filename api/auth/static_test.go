@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTokenFile writes a token file with the given content in a temporary directory and returns its path
+func writeTokenFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.csv")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	path := writeTokenFile(t, `# token,user,uid,"group1,group2"
+alice-token,alice,1001,"developers, operators"
+
+# The uid and groups are optional
+bob-token,bob
+carol-token, carol, 1003
+`)
+	authenticator, err := NewStaticTokenAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]*User{
+		"alice-token": {Name: "alice", UID: "1001", Groups: []string{"developers", "operators"}},
+		"bob-token":   {Name: "bob"},
+		"carol-token": {Name: "carol", UID: "1003"},
+	}
+	for token, want := range tests {
+		user, err := authenticator.Authenticate(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(user, want) {
+			t.Errorf("user of %s = %+v, want %+v", token, user, want)
+		}
+	}
+	for _, token := range []string{"mallory-token", "alice", "# token", ""} {
+		if _, err := authenticator.Authenticate(context.Background(), token); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("error of %q = %v, want ErrUnauthenticated", token, err)
+		}
+	}
+}
+
+func TestStaticTokenAuthenticatorErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty file":      "",
+		"only comments":   "# token,user\n",
+		"missing user":    "alice-token\n",
+		"empty user":      "alice-token,\n",
+		"unclosed quotes": "alice-token,alice,1001,\"developers\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewStaticTokenAuthenticator(writeTokenFile(t, content)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := NewStaticTokenAuthenticator(""); err == nil {
+		t.Error("expected an error without a token file")
+	}
+	if _, err := NewStaticTokenAuthenticator(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("expected an error for a missing token file")
+	}
+}
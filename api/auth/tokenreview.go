@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sync"
+	"time"
+)
+
+// tokenReviewCacheTTL is how long a successful TokenReview is reused, so a client polling the state endpoint
+// doesn't cost a TokenReview per request. Revoked tokens are rejected after at most this duration.
+const tokenReviewCacheTTL = 30 * time.Second
+
+// TokenReviewAuthenticator validates bearer tokens with the Kubernetes TokenReview API
+type TokenReviewAuthenticator struct {
+	clientset kubernetes.Interface
+	mutex     sync.Mutex
+	cache     map[[sha256.Size]byte]cachedUser
+}
+
+// cachedUser is a successfully reviewed token's user
+type cachedUser struct {
+	user    *User
+	expires time.Time
+}
+
+// NewTokenReviewAuthenticator returns an Authenticator that reviews tokens with the given clientset.
+// The server's service account needs the create permission on tokenreviews.authentication.k8s.io.
+func NewTokenReviewAuthenticator(clientset kubernetes.Interface) *TokenReviewAuthenticator {
+	return &TokenReviewAuthenticator{clientset: clientset, cache: map[[sha256.Size]byte]cachedUser{}}
+}
+
+func (authenticator *TokenReviewAuthenticator) Authenticate(ctx context.Context, token string) (*User, error) {
+	// Only a hash of the token is kept in memory
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	authenticator.mutex.Lock()
+	cached, ok := authenticator.cache[key]
+	authenticator.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.user, nil
+	}
+
+	review, err := authenticator.clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, v1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, &reviewError{reason: review.Status.Error}
+		}
+		return nil, ErrUnauthenticated
+	}
+	user := &User{
+		Name:   review.Status.User.Username,
+		UID:    review.Status.User.UID,
+		Groups: review.Status.User.Groups,
+	}
+	if len(review.Status.User.Extra) > 0 {
+		user.Extra = map[string][]string{}
+		for k, v := range review.Status.User.Extra {
+			user.Extra[k] = v
+		}
+	}
+
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+	// Drop the expired entries so the cache doesn't grow with every token ever seen
+	for k, entry := range authenticator.cache {
+		if !now.Before(entry.expires) {
+			delete(authenticator.cache, k)
+		}
+	}
+	authenticator.cache[key] = cachedUser{user: user, expires: now.Add(tokenReviewCacheTTL)}
+	return user, nil
+}
+
+// reviewError is a token rejected by the TokenReview API with a reason, it matches ErrUnauthenticated
+type reviewError struct {
+	reason string
+}
+
+func (err *reviewError) Error() string {
+	return ErrUnauthenticated.Error() + ": " + err.reason
+}
+
+func (err *reviewError) Is(target error) bool {
+	return target == ErrUnauthenticated
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newReviewingAuthenticator returns a TokenReviewAuthenticator whose reviews are answered by review,
+// and the reviewed tokens
+func newReviewingAuthenticator(review func(token string) authenticationv1.TokenReviewStatus) (*TokenReviewAuthenticator, *[]string) {
+	var tokens []string
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		object := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		tokens = append(tokens, object.Spec.Token)
+		object.Status = review(object.Spec.Token)
+		return true, object, nil
+	})
+	return NewTokenReviewAuthenticator(clientset), &tokens
+}
+
+func TestTokenReviewAuthenticatorCache(t *testing.T) {
+	authenticator, tokens := newReviewingAuthenticator(func(token string) authenticationv1.TokenReviewStatus {
+		if token != "alice-token" {
+			return authenticationv1.TokenReviewStatus{}
+		}
+		return authenticationv1.TokenReviewStatus{
+			Authenticated: true,
+			User: authenticationv1.UserInfo{
+				Username: "alice",
+				UID:      "1001",
+				Groups:   []string{"developers"},
+				Extra:    map[string]authenticationv1.ExtraValue{"scopes": {"read"}},
+			},
+		}
+	})
+	want := &User{Name: "alice", UID: "1001", Groups: []string{"developers"}, Extra: map[string][]string{"scopes": {"read"}}}
+	for i := 0; i < 2; i++ {
+		user, err := authenticator.Authenticate(context.Background(), "alice-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(user, want) {
+			t.Errorf("user = %+v, want %+v", user, want)
+		}
+	}
+	// The second request is served from the cache
+	if !reflect.DeepEqual(*tokens, []string{"alice-token"}) {
+		t.Errorf("reviewed tokens = %q, want a single review", *tokens)
+	}
+
+	// Rejected tokens are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := authenticator.Authenticate(context.Background(), "mallory-token"); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("error = %v, want ErrUnauthenticated", err)
+		}
+	}
+	if len(*tokens) != 3 {
+		t.Errorf("reviewed tokens = %q, want every rejected token to be reviewed", *tokens)
+	}
+
+	// Expired entries are reviewed again
+	authenticator.mutex.Lock()
+	for key, entry := range authenticator.cache {
+		entry.expires = time.Now().Add(-time.Second)
+		authenticator.cache[key] = entry
+	}
+	authenticator.mutex.Unlock()
+	if _, err := authenticator.Authenticate(context.Background(), "alice-token"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*tokens) != 4 {
+		t.Errorf("reviewed tokens = %q, want the expired token to be reviewed", *tokens)
+	}
+}
+
+func TestTokenReviewAuthenticatorErrors(t *testing.T) {
+	authenticator, _ := newReviewingAuthenticator(func(token string) authenticationv1.TokenReviewStatus {
+		return authenticationv1.TokenReviewStatus{Error: "token has expired"}
+	})
+	_, err := authenticator.Authenticate(context.Background(), "expired-token")
+	if !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("error = %v, want ErrUnauthenticated", err)
+	}
+	if want := "invalid bearer token: token has expired"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+
+	// A failed review is not an authentication failure
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	_, err = NewTokenReviewAuthenticator(clientset).Authenticate(context.Background(), "alice-token")
+	if err == nil || errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("error = %v, want the review error", err)
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"context"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+// GetOwningCronJob returns the name of the CronJob that created the job,
+// or an empty string when the job was created directly
+func GetOwningCronJob(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (string, error) {
+	job, err := clientset.BatchV1().Jobs(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if owner := v1.GetControllerOfNoCopy(job); owner != nil && strings.ToLower(owner.Kind) == KindCronJob {
+		return owner.Name, nil
+	}
+	return "", nil
+}
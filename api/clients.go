@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sync"
+)
+
+// ClientFactory builds Kubernetes clients from a base config. The clients of the server's own identity are
+// built once and shared, impersonated clients are derived from the base config per request.
+type ClientFactory struct {
+	config  *rest.Config
+	once    sync.Once
+	clients Clients
+	err     error
+}
+
+// NewClientFactory returns a ClientFactory for the base config
+func NewClientFactory(config *rest.Config) *ClientFactory {
+	return &ClientFactory{config: config}
+}
+
+// NewClientFactoryForClients returns a ClientFactory whose clients of the server's own identity are the given clients,
+// such as fake clients in tests. It has an empty base config, so its impersonated clients can't reach a cluster.
+func NewClientFactoryForClients(clients Clients) *ClientFactory {
+	factory := &ClientFactory{config: &rest.Config{}}
+	factory.once.Do(func() {
+		factory.clients = clients
+	})
+	return factory
+}
+
+// Config returns a copy of the base config
+func (factory *ClientFactory) Config() *rest.Config {
+	return rest.CopyConfig(factory.config)
+}
+
+// Clients returns the clients of the server's own identity
+func (factory *ClientFactory) Clients() (Clients, error) {
+	factory.once.Do(func() {
+		factory.clients, factory.err = newClients(factory.config)
+	})
+	return factory.clients, factory.err
+}
+
+// ImpersonatedClients returns clients that act as the impersonated user, so Kubernetes authorizes their requests
+// and records them in its audit log with the user's identity. The server needs the impersonate permission.
+func (factory *ClientFactory) ImpersonatedClients(impersonate rest.ImpersonationConfig) (Clients, error) {
+	config := factory.Config()
+	config.Impersonate = impersonate
+	return newClients(config)
+}
+
+func newClients(config *rest.Config) (Clients, error) {
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return Clients{}, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return Clients{}, err
+	}
+	return Clients{Kube: kube, Dynamic: dynamicClient}, nil
+}
+
+var (
+	// clientFactory is the factory used by GetClients and GetRequestClients, set with SetClientFactory
+	clientFactory      *ClientFactory
+	clientFactoryMutex sync.Mutex
+)
+
+// SetClientFactory sets the factory used by GetClients and GetRequestClients. It is called once before the server starts.
+func SetClientFactory(factory *ClientFactory) {
+	clientFactoryMutex.Lock()
+	defer clientFactoryMutex.Unlock()
+	clientFactory = factory
+}
+
+// getClientFactory returns the configured factory, or a factory of GetConfig when none was set
+func getClientFactory() (*ClientFactory, error) {
+	clientFactoryMutex.Lock()
+	defer clientFactoryMutex.Unlock()
+	if clientFactory == nil {
+		config, err := GetConfig()
+		if err != nil {
+			return nil, err
+		}
+		clientFactory = NewClientFactory(config)
+	}
+	return clientFactory, nil
+}
+
+// GetClients returns the Kubernetes clients of the server's own identity
+func GetClients() (Clients, error) {
+	factory, err := getClientFactory()
+	if err != nil {
+		return Clients{}, err
+	}
+	return factory.Clients()
+}
+
+// impersonationContextKey is the context key of the user a request's Kubernetes calls impersonate
+type impersonationContextKey struct{}
+
+// WithImpersonation returns a copy of ctx whose GetRequestClients impersonate the given user
+func WithImpersonation(ctx context.Context, impersonate rest.ImpersonationConfig) context.Context {
+	return context.WithValue(ctx, impersonationContextKey{}, impersonate)
+}
+
+// GetRequestClients returns the Kubernetes clients to act on behalf of a request: clients impersonating
+// the caller when the request context carries an impersonated user, see WithImpersonation,
+// and the clients of the server's own identity otherwise
+func GetRequestClients(ctx context.Context) (Clients, error) {
+	factory, err := getClientFactory()
+	if err != nil {
+		return Clients{}, err
+	}
+	if impersonate, ok := ctx.Value(impersonationContextKey{}).(rest.ImpersonationConfig); ok {
+		return factory.ImpersonatedClients(impersonate)
+	}
+	return factory.Clients()
+}
@@ -12,23 +12,50 @@ import (
 )
 
 const (
-	KindDeployment    = "deployment"
-	KindStatefulSet   = "statefulSet"
-	ActionAdd         = "add"
-	ActionDelete      = "delete"
-	ErrorDecodeJSON   = "Error decoding JSON body "
-	ErrorKubeConfig   = "Error getting Kubernetes config "
-	ErrorKubeClient   = "Error creating Kubernetes clientset "
-	ErrorInvalidInput = "Invalid input "
-	ErrorDynamic      = "Error getting dynamic client "
-	ErrorUpdate       = "Error updating resource "
-	ErrorGet          = "Error getting resource "
-	ErrorList         = "Error listing resources "
+	KindDeployment            = "deployment"
+	KindStatefulSet           = "statefulset"
+	KindDaemonSet             = "daemonset"
+	KindCronJob               = "cronjob"
+	KindJob                   = "job"
+	KindRollout               = "rollout"
+	ActionAdd                 = "add"
+	ActionDelete              = "delete"
+	ErrorDecodeJSON           = "Error decoding JSON body "
+	ErrorKubeConfig           = "Error getting Kubernetes config "
+	ErrorKubeClient           = "Error creating Kubernetes clientset "
+	ErrorInvalidInput         = "Invalid input "
+	ErrorDynamic              = "Error getting dynamic client "
+	ErrorRollback             = "Error rolling back resource "
+	ErrorUpdate               = "Error updating resource "
+	ErrorGet                  = "Error getting resource "
+	ErrorList                 = "Error listing resources "
+	ErrorNotFound             = "Resource not found "
+	ErrorCacheNotSynced       = "Resource cache is not synced yet "
+	ErrorWatch                = "Error watching resources "
+	ErrorEncodeJSON           = "Error encoding JSON "
+	ErrorStreamingUnsupported = "Streaming is not supported "
+	ErrorUnauthorized         = "Unauthorized "
+	ErrorAuthentication       = "Error authenticating request "
+	ErrorForbidden            = "Forbidden "
+	ErrorAudit                = "Error recording audit entry "
+	ErrorAuditQuery           = "Error reading audit entries "
+)
+
+// Pod template annotations managed by ezkonnect
+const (
+	InstrumentationAnnotation = "logz.io/traces_instrument"
+	ServiceNameAnnotation     = "logz.io/service-name"
+	LogTypeAnnotation         = "logz.io/application_type"
 )
 
 var (
-	ValidKinds   = []string{KindDeployment, KindStatefulSet}
+	// ManagedAnnotations are the pod template annotations ezkonnect reads and writes
+	ManagedAnnotations = []string{InstrumentationAnnotation, ServiceNameAnnotation, LogTypeAnnotation}
+	// ValidKinds are the supported workload kinds, filled by RegisterWorkloadKind
+	ValidKinds   []string
 	ValidActions = []string{ActionAdd, ActionDelete}
+	// AutoInstrumentationLanguages are the detected languages the instrumentor can instrument automatically
+	AutoInstrumentationLanguages = []string{"java", "python", "javascript", "dotnet"}
 )
 
 func InitLogger() zap.SugaredLogger {
@@ -0,0 +1,121 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/state"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// QueryVerbose lists the result of every check in the response
+	QueryVerbose = "verbose"
+	// checkTimeout bounds each readiness check so a slow API server fails the probe instead of hanging it
+	checkTimeout = 5 * time.Second
+)
+
+// check is a named readiness check, run returns nil when the check passed
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// readinessChecks are run in order by ReadinessHandler
+var readinessChecks = []check{
+	{name: "kubernetes-api", run: checkKubernetesAPI},
+	{name: "instrumentedapplications-crd", run: checkInstrumentedApplicationCRD},
+	{name: "instrumentedapplications-cache", run: checkCacheSynced},
+}
+
+// LivenessHandler reports that the process is up and serving requests, it doesn't check any dependency
+// so a Kubernetes API outage doesn't restart the server
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// ReadinessHandler reports whether the server can serve requests: the Kubernetes API server is reachable,
+// the InstrumentedApplication CRD is installed and the InstrumentedApplication cache has synced.
+// It returns 503 when a check failed, and lists every check's result with the verbose query parameter.
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	logger := api.InitLogger()
+	defer logger.Sync()
+	_, verbose := r.URL.Query()[QueryVerbose]
+	var report strings.Builder
+	failed := false
+	for _, c := range readinessChecks {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		err := c.run(ctx)
+		cancel()
+		if err != nil {
+			failed = true
+			logger.Warnw("Readiness check failed", "check", c.name, "error", err)
+			fmt.Fprintf(&report, "[-]%s failed: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(&report, "[+]%s ok\n", c.name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, report.String())
+		fmt.Fprint(w, "readyz check failed")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if verbose {
+		fmt.Fprint(w, report.String())
+		fmt.Fprint(w, "readyz check passed")
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// checkKubernetesAPI verifies that the API server is reachable
+func checkKubernetesAPI(ctx context.Context) error {
+	clients, err := api.GetClients()
+	if err != nil {
+		return err
+	}
+	// The discovery client doesn't take a context, use the REST client to honour the check timeout
+	return clients.Kube.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// checkInstrumentedApplicationCRD verifies that the InstrumentedApplication CRD is installed with the served version
+func checkInstrumentedApplicationCRD(ctx context.Context) error {
+	clients, err := api.GetClients()
+	if err != nil {
+		return err
+	}
+	groupVersion := state.InstrumentedApplicationGVR.GroupVersion().String()
+	body, err := clients.Kube.Discovery().RESTClient().Get().AbsPath("/apis", groupVersion).Do(ctx).Raw()
+	if err != nil {
+		return fmt.Errorf("%s is not served: %v", groupVersion, err)
+	}
+	var resources v1.APIResourceList
+	if err := json.Unmarshal(body, &resources); err != nil {
+		return err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == state.InstrumentedApplicationGVR.Resource {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not served in %s", state.InstrumentedApplicationGVR.Resource, groupVersion)
+}
+
+// checkCacheSynced verifies that the InstrumentedApplication cache completed its initial list
+func checkCacheSynced(ctx context.Context) error {
+	if !state.HasSynced() {
+		return state.ErrCacheNotSynced
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/metrics"
+	"net/url"
+	"time"
+)
+
+var (
+	kubernetesRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_requests_total",
+		Help:      "Number of Kubernetes API requests by method and status code, code is <error> when no response was received.",
+	}, []string{"method", "code"})
+	kubernetesRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_request_duration_seconds",
+		Help:      "Latency of Kubernetes API requests by verb.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"verb"})
+)
+
+// RegisterKubernetesClientMetrics makes the Kubernetes clients report their requests to the ezkonnect metrics.
+// It must be called before the clients are used, later calls have no effect.
+func RegisterKubernetesClientMetrics() {
+	metrics.Register(metrics.RegisterOpts{
+		RequestLatency: kubernetesLatency{},
+		RequestResult:  kubernetesResult{},
+	})
+}
+
+// kubernetesLatency implements metrics.LatencyMetric, the URL is not used as a label to keep the cardinality bounded
+type kubernetesLatency struct{}
+
+func (kubernetesLatency) Observe(ctx context.Context, verb string, u url.URL, latency time.Duration) {
+	kubernetesRequestDuration.WithLabelValues(verb).Observe(latency.Seconds())
+}
+
+// kubernetesResult implements metrics.ResultMetric
+type kubernetesResult struct{}
+
+func (kubernetesResult) Increment(ctx context.Context, code string, method string, host string) {
+	kubernetesRequests.WithLabelValues(method, code).Inc()
+}
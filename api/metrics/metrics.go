@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// namespace prefixes the names of all the ezkonnect metrics
+const namespace = "ezkonnect"
+
+// Annotate outcomes counted by ObserveAnnotate
+const (
+	OutcomeAdded          = "added"
+	OutcomeRolledBack     = "rolled_back"
+	OutcomeLogTypeSet     = "log_type_set"
+	OutcomeLogTypeRemoved = "log_type_removed"
+	OutcomeUnchanged      = "unchanged"
+	OutcomeFailed         = "failed"
+	// OutcomeReverted counts the resources restored after a failed atomic request
+	OutcomeReverted = "reverted"
+)
+
+// unmatchedRoute is the route label of requests that didn't match any route
+const unmatchedRoute = "unmatched"
+
+// Registry holds the ezkonnect metrics, it is served by Handler
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+	annotateOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "annotate_operations_total",
+		Help:      "Number of annotated resources by kind and outcome.",
+	}, []string{"kind", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		annotateOperations,
+		kubernetesRequests,
+		kubernetesRequestDuration,
+		stateCollector{},
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts the requests and observes their latency by route template, so requests to
+// /api/v1/state/{namespace}/{kind}/{name} are reported under a single route
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unmatchedRoute
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		code := strconv.Itoa(recorder.status)
+		httpRequests.WithLabelValues(route, r.Method, code).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveAnnotate counts an annotated resource of a kind with its outcome
+func ObserveAnnotate(kind string, outcome string) {
+	annotateOperations.WithLabelValues(kind, outcome).Inc()
+}
+
+// statusRecorder records the status code written by a handler.
+// It implements http.Flusher so streaming handlers keep working behind Middleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
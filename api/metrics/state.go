@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"github.com/logzio/ezkonnect-server/api/state"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	instrumentedWorkloadsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "instrumented_workloads"),
+		"Number of instrumented workloads by detected language.",
+		[]string{"language"}, nil,
+	)
+	detectionPhaseDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "instrumented_applications"),
+		"Number of InstrumentedApplication custom resources by detection phase.",
+		[]string{"detection_phase"}, nil,
+	)
+)
+
+// stateCollector reports gauges computed from the InstrumentedApplication cache at scrape time,
+// nothing is reported until the cache has synced
+type stateCollector struct{}
+
+func (stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instrumentedWorkloadsDesc
+	ch <- detectionPhaseDesc
+}
+
+func (stateCollector) Collect(ch chan<- prometheus.Metric) {
+	summary, err := state.Summarize()
+	if err != nil {
+		return
+	}
+	for language, count := range summary.InstrumentedByLanguage {
+		ch <- prometheus.MustNewConstMetric(instrumentedWorkloadsDesc, prometheus.GaugeValue, float64(count), language)
+	}
+	for phase, count := range summary.ByDetectionPhase {
+		ch <- prometheus.MustNewConstMetric(detectionPhaseDesc, prometheus.GaugeValue, float64(count), phase)
+	}
+}
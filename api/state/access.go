@@ -0,0 +1,137 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sync"
+	"time"
+)
+
+// namespaceAccessCacheTTL is how long a reviewed list permission is reused across requests, so a client polling
+// the state doesn't cost a SubjectAccessReview per namespace and request. Revoked permissions apply after at most
+// this duration.
+const namespaceAccessCacheTTL = 10 * time.Second
+
+// namespaceAccessCache holds the reviewed list permissions by a hash of the caller and the namespace,
+// shared by all the requests
+var namespaceAccessCache = struct {
+	mutex   sync.Mutex
+	entries map[[sha256.Size]byte]cachedAccess
+}{entries: map[[sha256.Size]byte]cachedAccess{}}
+
+// cachedAccess is a reviewed list permission
+type cachedAccess struct {
+	allowed bool
+	expires time.Time
+}
+
+// namespaceAccess checks whether the caller may list InstrumentedApplications in a namespace, see auth.Authorize.
+// The results are cached for the lifetime of the request, and for namespaceAccessCacheTTL across requests.
+type namespaceAccess struct {
+	ctx         context.Context
+	clusterWide *bool
+	namespaces  map[string]bool
+}
+
+func newNamespaceAccess(ctx context.Context) *namespaceAccess {
+	return &namespaceAccess{ctx: ctx, namespaces: map[string]bool{}}
+}
+
+// allows reports whether the caller may list InstrumentedApplications in the namespace.
+// Every namespace is allowed when authorization is disabled or the caller may list them in all namespaces.
+func (access *namespaceAccess) allows(namespace string) (bool, error) {
+	if !auth.AuthorizationEnabled(access.ctx) {
+		return true, nil
+	}
+	if access.clusterWide == nil {
+		allowed, err := access.review("")
+		if err != nil {
+			return false, err
+		}
+		access.clusterWide = &allowed
+	}
+	if *access.clusterWide {
+		return true, nil
+	}
+	allowed, ok := access.namespaces[namespace]
+	if !ok {
+		var err error
+		allowed, err = access.review(namespace)
+		if err != nil {
+			return false, err
+		}
+		access.namespaces[namespace] = allowed
+	}
+	return allowed, nil
+}
+
+// review checks the list permission in a namespace, or in all namespaces when namespace is empty
+func (access *namespaceAccess) review(namespace string) (bool, error) {
+	key, cacheable := namespaceAccessKey(access.ctx, namespace)
+	now := time.Now()
+	if cacheable {
+		namespaceAccessCache.mutex.Lock()
+		cached, ok := namespaceAccessCache.entries[key]
+		namespaceAccessCache.mutex.Unlock()
+		if ok && now.Before(cached.expires) {
+			return cached.allowed, nil
+		}
+	}
+
+	allowed, err := access.authorize(namespace)
+	if err != nil || !cacheable {
+		return allowed, err
+	}
+	namespaceAccessCache.mutex.Lock()
+	defer namespaceAccessCache.mutex.Unlock()
+	// Drop the expired entries so the cache doesn't grow with every caller ever seen
+	for k, entry := range namespaceAccessCache.entries {
+		if !now.Before(entry.expires) {
+			delete(namespaceAccessCache.entries, k)
+		}
+	}
+	namespaceAccessCache.entries[key] = cachedAccess{allowed: allowed, expires: now.Add(namespaceAccessCacheTTL)}
+	return allowed, nil
+}
+
+// namespaceAccessKey returns the cache key of the caller's list permission in a namespace. The permissions depend
+// on everything the SubjectAccessReview is sent, so the key covers the name, UID, groups and extra of the user.
+func namespaceAccessKey(ctx context.Context, namespace string) ([sha256.Size]byte, bool) {
+	user, ok := auth.UserFrom(ctx)
+	if !ok {
+		return [sha256.Size]byte{}, false
+	}
+	// The keys of the extra map are marshalled sorted
+	data, err := json.Marshal(struct {
+		User      *auth.User
+		Namespace string
+	}{user, namespace})
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(data), true
+}
+
+// authorize reviews the list permission in a namespace, or in all namespaces when namespace is empty
+func (access *namespaceAccess) authorize(namespace string) (bool, error) {
+	err := auth.Authorize(access.ctx, authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "list",
+		Group:     ResourceGroup,
+		Resource:  ResourceInstrumentedApplication,
+	})
+	if apierrors.IsForbidden(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NamespaceFilter returns a function reporting whether the caller of ctx may read the state of a namespace,
+// for endpoints that expose per-namespace data alongside the state. Its results are cached for the request.
+func NamespaceFilter(ctx context.Context) func(namespace string) (bool, error) {
+	return newNamespaceAccess(ctx).allows
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/logzio/ezkonnect-server/api/auth"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// useAccessReviews enables authorization with SubjectAccessReviews that allow listing in the shop namespace,
+// it returns the reviewed namespaces. The reviews fail while failing is set.
+func useAccessReviews(t *testing.T, failing *bool) *[]string {
+	var reviews []string
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if *failing {
+			return true, nil, errors.New("unavailable")
+		}
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, review.Spec.ResourceAttributes.Namespace)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Namespace == "shop"
+		return true, review, nil
+	})
+	if err := auth.ConfigureAuthorization(auth.AuthorizationSubjectAccessReview, auth.ModeTokenReview, clientset); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auth.ConfigureAuthorization(auth.AuthorizationNone, auth.ModeNone, nil)
+		namespaceAccessCache.entries = map[[sha256.Size]byte]cachedAccess{}
+	})
+	return &reviews
+}
+
+// checkAccess checks the access of a new request of the user to the shop and db namespaces
+func checkAccess(t *testing.T, user *auth.User) {
+	t.Helper()
+	access := newNamespaceAccess(auth.WithUser(context.Background(), user))
+	for namespace, want := range map[string]bool{"shop": true, "db": false} {
+		allowed, err := access.allows(namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != want {
+			t.Errorf("%s allowed = %v, want %v", namespace, allowed, want)
+		}
+	}
+}
+
+func TestNamespaceAccessCache(t *testing.T) {
+	failing := false
+	reviews := useAccessReviews(t, &failing)
+	alice := &auth.User{Name: "alice", Groups: []string{"developers"}}
+
+	checkAccess(t, alice)
+	if len(*reviews) != 3 {
+		t.Errorf("reviews = %q, want the cluster-wide, shop and db reviews", *reviews)
+	}
+	// Another request of the same caller reuses the reviews
+	*reviews = nil
+	checkAccess(t, &auth.User{Name: "alice", Groups: []string{"developers"}})
+	if len(*reviews) != 0 {
+		t.Errorf("reviews = %q, want the cached results", *reviews)
+	}
+	// The permissions of other groups are reviewed
+	checkAccess(t, &auth.User{Name: "alice", Groups: []string{"developers", "admins"}})
+	if len(*reviews) != 3 {
+		t.Errorf("reviews = %q, want the groups to be reviewed", *reviews)
+	}
+
+	// Expired results are reviewed again
+	namespaceAccessCache.mutex.Lock()
+	for key, entry := range namespaceAccessCache.entries {
+		entry.expires = time.Now().Add(-time.Second)
+		namespaceAccessCache.entries[key] = entry
+	}
+	namespaceAccessCache.mutex.Unlock()
+	*reviews = nil
+	checkAccess(t, alice)
+	if len(*reviews) != 3 {
+		t.Errorf("reviews = %q, want the expired results to be reviewed", *reviews)
+	}
+}
+
+func TestNamespaceAccessDoesNotCacheErrors(t *testing.T) {
+	failing := true
+	reviews := useAccessReviews(t, &failing)
+	ctx := auth.WithUser(context.Background(), &auth.User{Name: "alice"})
+	if _, err := newNamespaceAccess(ctx).allows("shop"); err == nil {
+		t.Fatal("expected the review error")
+	}
+	failing = false
+	if allowed, err := newNamespaceAccess(ctx).allows("shop"); err != nil || !allowed {
+		t.Errorf("allowed = %v, error = %v, want the shop namespace to be reviewed again", allowed, err)
+	}
+	if len(*reviews) != 2 {
+		t.Errorf("reviews = %q, want the cluster-wide and shop reviews", *reviews)
+	}
+}
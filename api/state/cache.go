@@ -0,0 +1,89 @@
+package state
+
+import (
+	"context"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/rest"
+	"time"
+)
+
+// informerResyncPeriod is how often the informer replays its cache to its handlers.
+// The state endpoints only read from the lister, so no periodic resync is needed.
+const informerResyncPeriod = 0 * time.Second
+
+// InstrumentedApplicationGVR is the GroupVersionResource of the InstrumentedApplication custom resource
+var InstrumentedApplicationGVR = schema.GroupVersionResource{
+	Group:    ResourceGroup,
+	Version:  ResourceVersion,
+	Resource: ResourceInstrumentedApplication,
+}
+
+// dynamicClient is the dynamic client shared by the informer and the watch-based stream endpoint
+var dynamicClient dynamic.Interface
+
+// instrumentedApplicationInformer is the long-lived shared informer backing the state endpoints.
+// It is set once by StartInformer before the server starts accepting requests.
+var instrumentedApplicationInformer informers.GenericInformer
+
+// StartInformer creates a dynamic shared informer for InstrumentedApplication custom resources
+// and starts it in the background. The informer stops when ctx is cancelled.
+func StartInformer(ctx context.Context, config *rest.Config) error {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	dynamicClient = client
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, informerResyncPeriod)
+	instrumentedApplicationInformer = factory.ForResource(InstrumentedApplicationGVR)
+	factory.Start(ctx.Done())
+	return nil
+}
+
+// HasSynced reports whether the InstrumentedApplication cache has completed its initial list
+func HasSynced() bool {
+	return instrumentedApplicationInformer != nil && instrumentedApplicationInformer.Informer().HasSynced()
+}
+
+// listInstrumentedApplications returns the cached InstrumentedApplication custom resources in the given namespace
+// that match the label selector. An empty namespace lists all namespaces.
+func listInstrumentedApplications(namespace string, selector labels.Selector) ([]*unstructured.Unstructured, error) {
+	lister := instrumentedApplicationInformer.Lister()
+	var objects []runtime.Object
+	var err error
+	if namespace == "" {
+		objects, err = lister.List(selector)
+	} else {
+		objects, err = lister.ByNamespace(namespace).List(selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, object := range objects {
+		if item, ok := object.(*unstructured.Unstructured); ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// listInstrumentedApplicationsPage lists a single page of InstrumentedApplication custom resources from the API server
+// and returns it with the continue token of the next page, which is empty on the last page
+func listInstrumentedApplicationsPage(ctx context.Context, namespace string, options v1.ListOptions) ([]*unstructured.Unstructured, string, error) {
+	list, err := dynamicClient.Resource(InstrumentedApplicationGVR).Namespace(namespace).List(ctx, options)
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]*unstructured.Unstructured, 0, len(list.Items))
+	for i := range list.Items {
+		items = append(items, &list.Items[i])
+	}
+	return items, list.GetContinue(), nil
+}
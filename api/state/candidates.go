@@ -0,0 +1,92 @@
+package state
+
+import (
+	"errors"
+	"github.com/logzio/ezkonnect-server/api"
+	"k8s.io/apimachinery/pkg/labels"
+	"sort"
+	"strings"
+)
+
+// DetectionPhaseCompleted is the detection phase of custom resources whose detection finished successfully
+const DetectionPhaseCompleted = "Completed"
+
+// ErrCacheNotSynced is returned when the InstrumentedApplication cache has not completed its initial list yet
+var ErrCacheNotSynced = errors.New("resource cache is not synced yet")
+
+// InstrumentationCandidate is a workload that can be instrumented automatically
+// name: the name of the workload
+// namespace: the namespace of the workload
+// controller_kind: the kind of the workload
+// languages: the supported languages detected in the workload's containers
+type InstrumentationCandidate struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	Kind      string   `json:"controller_kind"`
+	Languages []string `json:"languages"`
+}
+
+// ListInstrumentationCandidates returns the workloads in the given namespace, or in all namespaces when empty,
+// whose InstrumentedApplication completed detection with at least one of the given languages,
+// that are not instrumented yet and have no container preconfigured with OpenTelemetry.
+// It reads from the informer cache and returns ErrCacheNotSynced until the cache has synced.
+func ListInstrumentationCandidates(namespace string, languages []string) ([]InstrumentationCandidate, error) {
+	if !HasSynced() {
+		return nil, ErrCacheNotSynced
+	}
+	items, err := listInstrumentedApplications(namespace, labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	supported := map[string]bool{}
+	for _, language := range languages {
+		supported[strings.ToLower(language)] = true
+	}
+	var candidates []InstrumentationCandidate
+	seen := map[string]bool{}
+	for _, item := range items {
+		if api.IsInternalResource(item.GetName()) {
+			continue
+		}
+		application, _ := decodeInstrumentedApplication(item)
+		owner := application.controllerReference()
+		if owner == nil || !api.IsValidKind(application.controllerKind()) || application.Status.TracesInstrumented ||
+			!strings.EqualFold(application.Status.InstrumentationDetection.Phase, DetectionPhaseCompleted) {
+			continue
+		}
+		var detected []string
+		preconfigured := false
+		for _, language := range application.Spec.Languages {
+			preconfigured = preconfigured || language.OpentelemetryPreconfigured
+			if supported[strings.ToLower(language.Language)] {
+				detected = append(detected, language.Language)
+			}
+		}
+		if preconfigured || len(detected) == 0 {
+			continue
+		}
+		candidate := InstrumentationCandidate{
+			Name:      owner.Name,
+			Namespace: application.Namespace,
+			Kind:      application.controllerKind(),
+			Languages: detected,
+		}
+		key := candidate.Namespace + "/" + candidate.Kind + "/" + candidate.Name
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		candidates = append(candidates, candidate)
+	}
+	// Keep the order stable between requests, like the state endpoint does
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Namespace != candidates[j].Namespace {
+			return candidates[i].Namespace < candidates[j].Namespace
+		}
+		if candidates[i].Kind != candidates[j].Kind {
+			return candidates[i].Kind < candidates[j].Kind
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates, nil
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	QueryNamespace          = "namespace"
+	QueryControllerKind     = "controller_kind"
+	QueryLanguage           = "language"
+	QueryDetectionStatus    = "detection_status"
+	QueryTracesInstrumented = "traces_instrumented"
+	QueryLogType            = "log_type"
+	QueryName               = "name"
+	QueryLabelSelector      = "label_selector"
+	QueryLimit              = "limit"
+	QueryContinue           = "continue"
+	// globCharacters turn the name filter from a prefix match into a glob match
+	globCharacters = "*?["
+)
+
+// stateFilter holds the query parameters of GET /api/v1/state
+// namespace and labelSelector are applied when listing the custom resources,
+// the other fields are matched against every InstrumentdApplicationData entry.
+// limit and continueToken page through the custom resources using the Kubernetes list continue token.
+type stateFilter struct {
+	namespace          string
+	labelSelector      labels.Selector
+	controllerKind     string
+	language           string
+	detectionStatus    string
+	tracesInstrumented *bool
+	logType            string
+	name               string
+	limit              int64
+	continueToken      string
+}
+
+// parseStateFilter builds a stateFilter from the request query, returning an error for malformed values
+func parseStateFilter(query url.Values) (stateFilter, error) {
+	filter := stateFilter{
+		namespace:       query.Get(QueryNamespace),
+		controllerKind:  query.Get(QueryControllerKind),
+		language:        query.Get(QueryLanguage),
+		detectionStatus: query.Get(QueryDetectionStatus),
+		logType:         query.Get(QueryLogType),
+		name:            query.Get(QueryName),
+		continueToken:   query.Get(QueryContinue),
+		labelSelector:   labels.Everything(),
+	}
+	if selector := query.Get(QueryLabelSelector); selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %v", QueryLabelSelector, err)
+		}
+		filter.labelSelector = parsed
+	}
+	if value := query.Get(QueryTracesInstrumented); value != "" {
+		instrumented, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %v", QueryTracesInstrumented, err)
+		}
+		filter.tracesInstrumented = &instrumented
+	}
+	if value := query.Get(QueryLimit); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("invalid %s: must be a positive integer", QueryLimit)
+		}
+		filter.limit = limit
+	}
+	if strings.ContainsAny(filter.name, globCharacters) {
+		if _, err := path.Match(filter.name, ""); err != nil {
+			return filter, fmt.Errorf("invalid %s: %v", QueryName, err)
+		}
+	}
+	return filter, nil
+}
+
+// paginated reports whether the request pages through the custom resources,
+// which is served by the API server since the informer cache has no continue tokens
+func (filter stateFilter) paginated() bool {
+	return filter.limit > 0 || filter.continueToken != ""
+}
+
+// matches reports whether an entry passes all the entry level filters
+func (filter stateFilter) matches(entry InstrumentdApplicationData) bool {
+	if filter.controllerKind != "" && !strings.EqualFold(entry.ControllerKind, filter.controllerKind) {
+		return false
+	}
+	if filter.language != "" && (entry.Language == nil || !strings.EqualFold(*entry.Language, filter.language)) {
+		return false
+	}
+	if filter.detectionStatus != "" && !strings.EqualFold(entry.DetectionStatus, filter.detectionStatus) {
+		return false
+	}
+	if filter.tracesInstrumented != nil && entry.TracesInstrumented != *filter.tracesInstrumented {
+		return false
+	}
+	if filter.logType != "" && (entry.LogType == nil || *entry.LogType != filter.logType) {
+		return false
+	}
+	return filter.matchesName(entry.Name)
+}
+
+// matchesName matches the name filter as a glob when it contains glob characters and as a prefix otherwise
+func (filter stateFilter) matchesName(name string) bool {
+	if filter.name == "" {
+		return true
+	}
+	if strings.ContainsAny(filter.name, globCharacters) {
+		matched, _ := path.Match(filter.name, name)
+		return matched
+	}
+	return strings.HasPrefix(name, filter.name)
+}
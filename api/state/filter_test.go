@@ -0,0 +1,113 @@
+package state
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseStateFilter(t *testing.T) {
+	filter, err := parseStateFilter(url.Values{
+		QueryNamespace:          {"shop"},
+		QueryControllerKind:     {"deployment"},
+		QueryLanguage:           {"java"},
+		QueryDetectionStatus:    {"Completed"},
+		QueryTracesInstrumented: {"false"},
+		QueryLogType:            {"log"},
+		QueryName:               {"payments-*"},
+		QueryLabelSelector:      {"team=payments,tier!=frontend"},
+		QueryLimit:              {"50"},
+		QueryContinue:           {"token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.namespace != "shop" || filter.controllerKind != "deployment" || filter.language != "java" ||
+		filter.detectionStatus != "Completed" || filter.logType != "log" || filter.name != "payments-*" ||
+		filter.limit != 50 || filter.continueToken != "token" {
+		t.Errorf("filter = %+v", filter)
+	}
+	if filter.tracesInstrumented == nil || *filter.tracesInstrumented {
+		t.Errorf("traces instrumented = %v, want false", filter.tracesInstrumented)
+	}
+	if selector := filter.labelSelector.String(); selector != "team=payments,tier!=frontend" {
+		t.Errorf("label selector = %q", selector)
+	}
+	if !filter.paginated() {
+		t.Error("a request with a limit isn't paginated")
+	}
+
+	filter, err = parseStateFilter(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.paginated() || filter.tracesInstrumented != nil || !filter.labelSelector.Empty() {
+		t.Errorf("filter = %+v, want no filters", filter)
+	}
+}
+
+func TestParseStateFilterErrors(t *testing.T) {
+	tests := map[string]url.Values{
+		"invalid label selector":      {QueryLabelSelector: {"team in (payments"}},
+		"invalid traces instrumented": {QueryTracesInstrumented: {"maybe"}},
+		"zero limit":                  {QueryLimit: {"0"}},
+		"negative limit":              {QueryLimit: {"-1"}},
+		"invalid limit":               {QueryLimit: {"many"}},
+		"invalid glob":                {QueryName: {"payments-["}},
+	}
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseStateFilter(query); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestStateFilterMatches(t *testing.T) {
+	java, log := "java", "log"
+	instrumented := true
+	entry := InstrumentdApplicationData{
+		Name:               "payments-api",
+		ControllerKind:     "deployment",
+		Language:           &java,
+		DetectionStatus:    "Completed",
+		TracesInstrumented: true,
+		LogType:            &log,
+	}
+	tests := []struct {
+		name     string
+		filter   stateFilter
+		expected bool
+	}{
+		{"no filters", stateFilter{}, true},
+		{"controller kind ignores case", stateFilter{controllerKind: "Deployment"}, true},
+		{"other controller kind", stateFilter{controllerKind: "statefulset"}, false},
+		{"language ignores case", stateFilter{language: "JAVA"}, true},
+		{"other language", stateFilter{language: "python"}, false},
+		{"detection status", stateFilter{detectionStatus: "completed"}, true},
+		{"other detection status", stateFilter{detectionStatus: "Running"}, false},
+		{"traces instrumented", stateFilter{tracesInstrumented: &instrumented}, true},
+		{"log type", stateFilter{logType: "log"}, true},
+		{"log type is case sensitive", stateFilter{logType: "LOG"}, false},
+		{"name prefix", stateFilter{name: "payments"}, true},
+		{"other name prefix", stateFilter{name: "api"}, false},
+		{"name glob", stateFilter{name: "*-api"}, true},
+		{"other name glob", stateFilter{name: "payments-?"}, false},
+		{"all filters", stateFilter{controllerKind: "deployment", language: "java", name: "payments-*", logType: "log"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matched := test.filter.matches(entry); matched != test.expected {
+				t.Errorf("matches = %v, want %v", matched, test.expected)
+			}
+		})
+	}
+
+	// Entries without a language or log type don't match those filters
+	if (stateFilter{language: "java"}).matches(InstrumentdApplicationData{}) {
+		t.Error("an entry without a language matched the language filter")
+	}
+	if (stateFilter{logType: "log"}).matches(InstrumentdApplicationData{}) {
+		t.Error("an entry without a log type matched the log type filter")
+	}
+}
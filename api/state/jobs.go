@@ -0,0 +1,81 @@
+package state
+
+import (
+	"context"
+	"github.com/logzio/ezkonnect-server/api"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+const (
+	// cronJobCacheSize bounds the number of jobs whose owning CronJob is cached
+	cronJobCacheSize = 10000
+	// cronJobCacheTTL is how long the owning CronJob of a job is cached. The owner of a job never changes,
+	// the TTL only lets the entries of deleted jobs expire.
+	cronJobCacheTTL = 24 * time.Hour
+)
+
+// cronJobCache holds the owning CronJob of the jobs by job UID, shared by all the requests so every job
+// is looked up once instead of on each state request. Jobs without a CronJob are cached with an empty name.
+var cronJobCache = cache.NewLRUExpireCache(cronJobCacheSize)
+
+// cronJobResolver reports InstrumentedApplications of jobs created by a CronJob as belonging to the CronJob,
+// since the jobs are short-lived and instrumenting them means annotating the CronJob's job template.
+// The owning CronJob of each job is looked up once and kept in cronJobs.
+type cronJobResolver struct {
+	clientset kubernetes.Interface
+	cronJobs  *cache.LRUExpireCache
+}
+
+func newCronJobResolver() *cronJobResolver {
+	return &cronJobResolver{cronJobs: cronJobCache}
+}
+
+// resolve rewrites the name and controller kind of the entries of a job owned InstrumentedApplication
+// to its owning CronJob. Entries of jobs created directly are left unchanged.
+func (resolver *cronJobResolver) resolve(ctx context.Context, item *unstructured.Unstructured, entries []InstrumentdApplicationData) error {
+	if len(entries) == 0 || entries[0].ControllerKind != api.KindJob {
+		return nil
+	}
+	var jobName, key string
+	for _, owner := range item.GetOwnerReferences() {
+		if strings.ToLower(owner.Kind) == api.KindJob {
+			jobName, key = owner.Name, string(owner.UID)
+		}
+	}
+	// Owner references always carry the UID, the name is only a fallback for hand-written objects
+	if key == "" {
+		key = item.GetNamespace() + "/" + jobName
+	}
+	var cronJobName string
+	if cached, ok := resolver.cronJobs.Get(key); ok {
+		cronJobName = cached.(string)
+	} else {
+		if resolver.clientset == nil {
+			clients, err := api.GetClients()
+			if err != nil {
+				return err
+			}
+			resolver.clientset = clients.Kube
+		}
+		var err error
+		cronJobName, err = api.GetOwningCronJob(ctx, resolver.clientset, item.GetNamespace(), jobName)
+		// Completed jobs may already be garbage collected, keep reporting them as jobs
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		resolver.cronJobs.Add(key, cronJobName, cronJobCacheTTL)
+	}
+	if cronJobName == "" {
+		return nil
+	}
+	for i := range entries {
+		entries[i].Name = cronJobName
+		entries[i].ControllerKind = api.KindCronJob
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/logzio/ezkonnect-server/api"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCronJobResolverSharesLookups(t *testing.T) {
+	controller := true
+	clientset := fake.NewSimpleClientset(&batchv1.Job{ObjectMeta: v1.ObjectMeta{
+		Name:      "report-28000000",
+		Namespace: "default",
+		UID:       "job-uid",
+		OwnerReferences: []v1.OwnerReference{
+			{APIVersion: "batch/v1", Kind: "CronJob", Name: "report", UID: "cronjob-uid", Controller: &controller},
+		},
+	}})
+	item := &unstructured.Unstructured{}
+	item.SetNamespace("default")
+	item.SetName("job-report-28000000")
+	item.SetOwnerReferences([]v1.OwnerReference{
+		{APIVersion: "batch/v1", Kind: "Job", Name: "report-28000000", UID: "job-uid", Controller: &controller},
+	})
+
+	shared := cache.NewLRUExpireCache(10)
+	// Every request creates its own resolver, the lookups are shared between them
+	for i := 0; i < 3; i++ {
+		resolver := &cronJobResolver{clientset: clientset, cronJobs: shared}
+		entries := []InstrumentdApplicationData{{Name: "report-28000000", ControllerKind: api.KindJob}}
+		if err := resolver.resolve(context.Background(), item, entries); err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].Name != "report" || entries[0].ControllerKind != api.KindCronJob {
+			t.Fatalf("entry = %+v, want the report cronjob", entries[0])
+		}
+	}
+	if actions := clientset.Actions(); len(actions) != 1 {
+		t.Errorf("got %d Kubernetes calls, want a single job lookup: %v", len(actions), actions)
+	}
+}
+
+func TestCronJobResolverKeepsDeletedJobs(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	item := &unstructured.Unstructured{}
+	item.SetNamespace("default")
+	item.SetOwnerReferences([]v1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: "migrate", UID: "deleted-uid"}})
+	resolver := &cronJobResolver{clientset: clientset, cronJobs: cache.NewLRUExpireCache(10)}
+	for i := 0; i < 2; i++ {
+		entries := []InstrumentdApplicationData{{Name: "migrate", ControllerKind: api.KindJob}}
+		if err := resolver.resolve(context.Background(), item, entries); err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].Name != "migrate" || entries[0].ControllerKind != api.KindJob {
+			t.Fatalf("entry = %+v, want the migrate job", entries[0])
+		}
+	}
+	if actions := clientset.Actions(); len(actions) != 1 {
+		t.Errorf("got %d Kubernetes calls, want the missing job to be cached: %v", len(actions), actions)
+	}
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/ezkonnect-server/api"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"strings"
+)
+
+// InstrumentedApplicationDetails is the state of a single workload
+// name: the name of the workload
+// namespace: the namespace of the workload
+// controller_kind: the kind of the workload
+// containers: the detection results of the workload's containers, empty until the workload was detected
+// pod_template_annotations: the ezkonnect annotations currently set on the workload's pod template (desired state),
+// or on the workload annotated in its place, such as the Deployment referenced by a Rollout or the CronJob of a job
+type InstrumentedApplicationDetails struct {
+	Name                   string                       `json:"name"`
+	Namespace              string                       `json:"namespace"`
+	ControllerKind         string                       `json:"controller_kind"`
+	Containers             []InstrumentdApplicationData `json:"containers"`
+	PodTemplateAnnotations map[string]string            `json:"pod_template_annotations"`
+}
+
+// GetCustomResourceHandler returns the state of a single workload identified by the namespace, kind and name path variables.
+// It combines the detected state of the workload's InstrumentedApplication custom resource
+// with the live pod template annotations of the workload, and returns 404 when the workload does not exist.
+// When authorization is enabled, it returns 403 when the caller cannot list InstrumentedApplications in the namespace.
+func GetCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
+	logger := api.InitLogger()
+	defer logger.Sync()
+	vars := mux.Vars(r)
+	namespace, kind, name := vars["namespace"], strings.ToLower(vars["kind"]), vars["name"]
+	if !api.IsValidKind(kind) {
+		logger.Error(api.ErrorInvalidInput, kind)
+		http.Error(w, api.ErrorInvalidInput+kind, http.StatusBadRequest)
+		return
+	}
+	if !HasSynced() {
+		logger.Warn(api.ErrorCacheNotSynced)
+		http.Error(w, api.ErrorCacheNotSynced, http.StatusServiceUnavailable)
+		return
+	}
+	allowed, err := newNamespaceAccess(r.Context()).allows(namespace)
+	if err != nil {
+		logger.Error(api.ErrorForbidden, zap.Error(err))
+		http.Error(w, api.ErrorForbidden+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		logger.Warn(api.ErrorForbidden, namespace)
+		http.Error(w, api.ErrorForbidden+namespace, http.StatusForbidden)
+		return
+	}
+
+	clients, err := api.GetRequestClients(r.Context())
+	if err != nil {
+		logger.Error(api.ErrorKubeClient, zap.Error(err))
+		http.Error(w, api.ErrorKubeClient+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The annotations are read from the workload the annotate endpoints change, such as the Deployment
+	// referenced by a Rollout's spec.workloadRef
+	annotatedKind, annotatedName, err := api.ResolveWorkload(r.Context(), clients, kind, namespace, name)
+	var annotations map[string]string
+	if err == nil {
+		annotations, err = api.GetPodTemplateAnnotations(r.Context(), clients, annotatedKind, namespace, annotatedName)
+	}
+	if err != nil {
+		logger.Error(api.ErrorGet, zap.Error(err))
+		if apierrors.IsNotFound(err) {
+			http.Error(w, api.ErrorNotFound+err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, api.ErrorGet+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	instrumentedApplications, err := listInstrumentedApplications(namespace, labels.Everything())
+	if err != nil {
+		logger.Error(api.ErrorList, zap.Error(err))
+		http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	details := InstrumentedApplicationDetails{
+		Name:                   name,
+		Namespace:              namespace,
+		ControllerKind:         kind,
+		Containers:             []InstrumentdApplicationData{},
+		PodTemplateAnnotations: map[string]string{},
+	}
+	resolver := newCronJobResolver()
+	var newestRun *unstructured.Unstructured
+	for _, item := range instrumentedApplications {
+		entries := instrumentedApplicationData(item)
+		if err := resolver.resolve(r.Context(), item, entries); err != nil {
+			logger.Warnw(api.ErrorGet, "name", item.GetName(), "namespace", item.GetNamespace(), "error", err)
+		}
+		if !ownsWorkload(item.GetOwnerReferences(), kind, name) && (entries[0].Name != name || entries[0].ControllerKind != kind) {
+			continue
+		}
+		// Every run of a CronJob has its own custom resource, only the entries of the newest run are returned
+		if kind == api.KindCronJob {
+			if newestRun != nil {
+				newest, created := newestRun.GetCreationTimestamp(), item.GetCreationTimestamp()
+				if !newest.Before(&created) {
+					continue
+				}
+			}
+			newestRun = item
+			details.Containers = entries
+			continue
+		}
+		details.Containers = append(details.Containers, entries...)
+	}
+	for _, key := range api.ManagedAnnotations {
+		if value, ok := annotations[key]; ok {
+			details.PodTemplateAnnotations[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(details)
+}
+
+// ownsWorkload reports whether one of the owner references points to the workload
+func ownsWorkload(owners []v1.OwnerReference, kind string, name string) bool {
+	for _, owner := range owners {
+		if strings.EqualFold(owner.Kind, kind) && owner.Name == name {
+			return true
+		}
+	}
+	return false
+}
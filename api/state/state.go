@@ -3,19 +3,22 @@ package state
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/logzio/ezkonnect-server/api"
 	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"net/http"
-	"strings"
+	"sort"
 )
 
 const (
 	ResourceGroup                   = "logz.io"
 	ResourceVersion                 = "v1alpha1"
 	ResourceInstrumentedApplication = "instrumentedapplications"
+	// ContinueTokenHeader holds the continue token of the next page in paginated responses
+	ContinueTokenHeader = "X-Continue-Token"
 )
 
 // InstrumentdApplicationData is the data structure for the custom resource
@@ -29,20 +32,25 @@ const (
 // language: the language of the application that the container belongs to
 // detection_status: the status of the detection process
 // log_type: the log type of the application that the container belongs to
+// warnings: problems found while parsing the custom resource, omitted when there are none
 type InstrumentdApplicationData struct {
-	Name                       string  `json:"name"`
-	Namespace                  string  `json:"namespace"`
-	ControllerKind             string  `json:"controller_kind"`
-	ContainerName              *string `json:"container_name"`
-	TracesInstrumented         bool    `json:"traces_instrumented"`
-	Application                *string `json:"application"`
-	Language                   *string `json:"language"`
-	DetectionStatus            string  `json:"detection_status"`
-	OpentelemetryPreconfigured *bool   `json:"opentelemetry_preconfigured"`
-	LogType                    *string `json:"log_type"`
+	Name                       string   `json:"name"`
+	Namespace                  string   `json:"namespace"`
+	ControllerKind             string   `json:"controller_kind"`
+	ContainerName              *string  `json:"container_name"`
+	TracesInstrumented         bool     `json:"traces_instrumented"`
+	Application                *string  `json:"application"`
+	Language                   *string  `json:"language"`
+	DetectionStatus            string   `json:"detection_status"`
+	OpentelemetryPreconfigured *bool    `json:"opentelemetry_preconfigured"`
+	LogType                    *string  `json:"log_type"`
+	Warnings                   []string `json:"warnings,omitempty"`
 }
 
-// GetCustomResourcesHandler lists all custom resources of type InstrumentedApplication
+// GetCustomResourcesHandler lists all custom resources of type InstrumentedApplication matching the query filters.
+// It reads from the shared informer cache and returns 503 until the cache has synced.
+// Paginated requests (limit or continue) are listed from the API server instead, see stateCollector.listPages.
+// When authorization is enabled, the custom resources of namespaces the caller cannot list are left out.
 func GetCustomResourcesHandler(w http.ResponseWriter, r *http.Request) {
 	logger := api.InitLogger()
 	defer logger.Sync()
@@ -50,105 +58,220 @@ func GetCustomResourcesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	config, err := api.GetConfig()
+	filter, err := parseStateFilter(r.URL.Query())
 	if err != nil {
-		logger.Error(api.ErrorKubeConfig, zap.Error(err))
-		http.Error(w, api.ErrorKubeConfig+err.Error(), http.StatusInternalServerError)
+		logger.Error(api.ErrorInvalidInput, zap.Error(err))
+		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Create a dynamic client
-	dynamicClient, err := dynamic.NewForConfig(config)
-	if err != nil {
-		logger.Error(api.ErrorDynamic, zap.Error(err))
-		http.Error(w, api.ErrorDynamic+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	gvr := schema.GroupVersionResource{
-		Group:    ResourceGroup,
-		Version:  ResourceVersion,
-		Resource: ResourceInstrumentedApplication,
+	collector := newStateCollector(r.Context(), logger, filter)
+	if filter.paginated() {
+		// Pages are listed from the API server, the continue token of the next page is returned in a header
+		continueToken, err := collector.listPages(listInstrumentedApplicationsPage)
+		if err != nil {
+			logger.Error(err)
+			// The continue token expired, the client has to restart from the first page
+			if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(ContinueTokenHeader, continueToken)
+	} else {
+		// Serve from the informer cache, which is only usable after its initial list completed
+		if !HasSynced() {
+			logger.Warn(api.ErrorCacheNotSynced)
+			http.Error(w, api.ErrorCacheNotSynced, http.StatusServiceUnavailable)
+			return
+		}
+		instrumentedApplications, err := listInstrumentedApplications(filter.namespace, filter.labelSelector)
+		if err != nil {
+			logger.Error(api.ErrorList, zap.Error(err))
+			http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Keep the order stable between requests, like the API server does
+		sort.Slice(instrumentedApplications, func(i, j int) bool {
+			if instrumentedApplications[i].GetNamespace() != instrumentedApplications[j].GetNamespace() {
+				return instrumentedApplications[i].GetNamespace() < instrumentedApplications[j].GetNamespace()
+			}
+			return instrumentedApplications[i].GetName() < instrumentedApplications[j].GetName()
+		})
+		if err := collector.add(instrumentedApplications); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
-	// List all custom resources
-	instrumentedApplicationsList, err := dynamicClient.Resource(gvr).Namespace("").List(context.Background(), v1.ListOptions{})
-	if err != nil {
-		logger.Error(api.ErrorList, zap.Error(err))
-		http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
-		return
+	data, _ := collector.data()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// pageLister lists a page of InstrumentedApplication custom resources, see listInstrumentedApplicationsPage
+type pageLister func(ctx context.Context, namespace string, options v1.ListOptions) ([]*unstructured.Unstructured, string, error)
+
+// stateCollector builds the entries of the custom resources of a state request, leaving out the custom resources
+// of the namespaces the caller cannot list and internal resources.
+// Every run of a CronJob has its own custom resource, only the entries of the newest run are kept.
+type stateCollector struct {
+	ctx           context.Context
+	logger        zap.SugaredLogger
+	filter        stateFilter
+	access        *namespaceAccess
+	resolver      *cronJobResolver
+	groups        [][]InstrumentdApplicationData
+	cronJobGroups map[string]int
+	cronJobRuns   map[string]*unstructured.Unstructured
+}
+
+func newStateCollector(ctx context.Context, logger zap.SugaredLogger, filter stateFilter) *stateCollector {
+	return &stateCollector{
+		ctx:           ctx,
+		logger:        logger,
+		filter:        filter,
+		access:        newNamespaceAccess(ctx),
+		resolver:      newCronJobResolver(),
+		cronJobGroups: map[string]int{},
+		cronJobRuns:   map[string]*unstructured.Unstructured{},
 	}
-	// Build a list of InstrumentdApplicationData from the custom resources
-	var data []InstrumentdApplicationData
-	for _, item := range instrumentedApplicationsList.Items {
-		name := item.GetName()
+}
+
+// add collects the entries of the custom resources. It fails when the caller's permissions can't be checked.
+func (collector *stateCollector) add(items []*unstructured.Unstructured) error {
+	for _, item := range items {
+		allowed, err := collector.access.allows(item.GetNamespace())
+		if err != nil {
+			return fmt.Errorf("%s%w", api.ErrorForbidden, err)
+		}
 		// Skip internal resources
-		if api.IsInternalResource(name) {
+		if !allowed || api.IsInternalResource(item.GetName()) {
+			continue
+		}
+		entries := instrumentedApplicationData(item)
+		if len(entries[0].Warnings) > 0 {
+			collector.logger.Warnw("Malformed custom resource", "name", item.GetName(), "namespace", item.GetNamespace(), "warnings", entries[0].Warnings)
+		}
+		if err := collector.resolver.resolve(collector.ctx, item, entries); err != nil {
+			collector.logger.Warnw(api.ErrorGet, "name", item.GetName(), "namespace", item.GetNamespace(), "error", err)
+		}
+		if entries[0].ControllerKind != api.KindCronJob {
+			collector.groups = append(collector.groups, entries)
+			continue
+		}
+		key := entries[0].Namespace + "/" + entries[0].Name
+		index, seen := collector.cronJobGroups[key]
+		if !seen {
+			collector.cronJobGroups[key] = len(collector.groups)
+			collector.cronJobRuns[key] = item
+			collector.groups = append(collector.groups, entries)
 			continue
 		}
-		namespace := item.GetNamespace()
-		ControllerKind := strings.ToLower(item.GetOwnerReferences()[0].Kind)
-		status := item.Object["status"].(map[string]interface{})
-		spec := item.Object["spec"].(map[string]interface{})
-		logType := spec["logType"].(string)
+		newest, created := collector.cronJobRuns[key].GetCreationTimestamp(), item.GetCreationTimestamp()
+		if newest.Before(&created) {
+			collector.cronJobRuns[key] = item
+			collector.groups[index] = entries
+		}
+	}
+	return nil
+}
 
-		// Check if the languages field is present in the spec
-		languages, langOk := spec["languages"].([]interface{})
-		if langOk {
-			// Handle the languages field
-			for _, language := range languages {
-				langStr := language.(map[string]interface{})["language"].(string)
-				containerNameStr := language.(map[string]interface{})["containerName"].(string)
-				otelDetectedBool := language.(map[string]interface{})["opentelemetryPreconfigured"].(bool)
-				entry := InstrumentdApplicationData{
-					Name:                       name,
-					Namespace:                  namespace,
-					ControllerKind:             ControllerKind,
-					TracesInstrumented:         status["tracesInstrumented"].(bool),
-					ContainerName:              &containerNameStr,
-					Language:                   &langStr,
-					DetectionStatus:            status["instrumentationDetection"].(map[string]interface{})["phase"].(string),
-					LogType:                    &logType,
-					OpentelemetryPreconfigured: &otelDetectedBool,
-				}
+// data returns the collected entries that match the filter, and the number of custom resources they belong to
+func (collector *stateCollector) data() ([]InstrumentdApplicationData, int64) {
+	var data []InstrumentdApplicationData
+	var resources int64
+	for _, entries := range collector.groups {
+		matched := false
+		for _, entry := range entries {
+			if collector.filter.matches(entry) {
 				data = append(data, entry)
+				matched = true
 			}
 		}
-		// Check if the applications field is present in the spec
-		applications, appOk := spec["applications"].([]interface{})
-		// Handle the applications field
-		if appOk {
-			for _, application := range applications {
-				applicationStr := application.(map[string]interface{})["application"].(string)
-				containerNameStr := application.(map[string]interface{})["containerName"].(string)
-				otelDetectedBool := false
-				entry := InstrumentdApplicationData{
-					Name:                       name,
-					Namespace:                  namespace,
-					ControllerKind:             ControllerKind,
-					TracesInstrumented:         status["tracesInstrumented"].(bool),
-					ContainerName:              &containerNameStr,
-					Application:                &applicationStr,
-					DetectionStatus:            status["instrumentationDetection"].(map[string]interface{})["phase"].(string),
-					LogType:                    &logType,
-					OpentelemetryPreconfigured: &otelDetectedBool,
-				}
-				data = append(data, entry)
-			}
+		if matched {
+			resources++
 		}
-		// Handle the case where the languages and applications fields are not present in the spec
-		if !langOk && !appOk {
-			otelDetectedBool := false
-			entry := InstrumentdApplicationData{
-				Name:                       name,
-				Namespace:                  namespace,
-				ControllerKind:             ControllerKind,
-				TracesInstrumented:         status["tracesInstrumented"].(bool),
-				DetectionStatus:            status["instrumentationDetection"].(map[string]interface{})["phase"].(string),
-				LogType:                    &logType,
-				OpentelemetryPreconfigured: &otelDetectedBool,
-			}
-			data = append(data, entry)
+	}
+	return data, resources
+}
+
+// listPages collects pages of custom resources starting at the filter's continue token, until limit custom resources
+// with matching entries are collected or the last page is listed. The entry level filters, the namespace permissions
+// and the CronJob runs leave out some of the listed custom resources, so a single page could come back short or empty.
+// Every page only lists the missing number of custom resources, and listPages returns the continue token that
+// follows the last one, which is empty after the last page.
+func (collector *stateCollector) listPages(listPage pageLister) (string, error) {
+	continueToken := collector.filter.continueToken
+	for {
+		options := v1.ListOptions{LabelSelector: collector.filter.labelSelector.String(), Continue: continueToken}
+		if collector.filter.limit > 0 {
+			_, collected := collector.data()
+			options.Limit = collector.filter.limit - collected
+		}
+		items, next, err := listPage(collector.ctx, collector.filter.namespace, options)
+		if err != nil {
+			return "", fmt.Errorf("%s%w", api.ErrorList, err)
+		}
+		if err := collector.add(items); err != nil {
+			return "", err
+		}
+		continueToken = next
+		if continueToken == "" {
+			return "", nil
+		}
+		if _, collected := collector.data(); collected >= collector.filter.limit {
+			return continueToken, nil
 		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(data)
+}
+
+// instrumentedApplicationData converts an InstrumentedApplication custom resource to one entry per detected container.
+// Fields that are missing or malformed are left empty and reported in the warnings of every entry.
+func instrumentedApplicationData(item *unstructured.Unstructured) []InstrumentdApplicationData {
+	application, warnings := decodeInstrumentedApplication(item)
+	newEntry := func(containerName string) InstrumentdApplicationData {
+		otelDetectedBool := false
+		entry := InstrumentdApplicationData{
+			Name:                       application.Name,
+			Namespace:                  application.Namespace,
+			ControllerKind:             application.controllerKind(),
+			TracesInstrumented:         application.Status.TracesInstrumented,
+			DetectionStatus:            application.Status.InstrumentationDetection.Phase,
+			OpentelemetryPreconfigured: &otelDetectedBool,
+			Warnings:                   warnings,
+		}
+		if containerName != "" {
+			entry.ContainerName = &containerName
+		}
+		if logType := application.Spec.LogType; logType != "" {
+			entry.LogType = &logType
+		}
+		return entry
+	}
+
+	var data []InstrumentdApplicationData
+	// Handle the languages field
+	for _, language := range application.Spec.Languages {
+		entry := newEntry(language.ContainerName)
+		langStr := language.Language
+		otelDetectedBool := language.OpentelemetryPreconfigured
+		entry.Language = &langStr
+		entry.OpentelemetryPreconfigured = &otelDetectedBool
+		data = append(data, entry)
+	}
+	// Handle the applications field
+	for _, app := range application.Spec.Applications {
+		entry := newEntry(app.ContainerName)
+		applicationStr := app.Application
+		entry.Application = &applicationStr
+		data = append(data, entry)
+	}
+	// Handle the case where the languages and applications fields are not present in the spec
+	if len(data) == 0 {
+		data = append(data, newEntry(""))
+	}
+	return data
 }
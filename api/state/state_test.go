@@ -0,0 +1,149 @@
+package state
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/logzio/ezkonnect-server/api"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestInstrumentedApplicationDataOfRollouts(t *testing.T) {
+	// Argo Rollouts own the InstrumentedApplication of their pods, whether they have their own pod template
+	// or reference a Deployment with spec.workloadRef
+	for _, name := range []string{"checkout", "checkout-workload-ref"} {
+		item := instrumentedApplicationFixture(func(object map[string]interface{}) {
+			object["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{
+				map[string]interface{}{
+					"apiVersion": "argoproj.io/v1alpha1",
+					"kind":       "Rollout",
+					"name":       name,
+					"uid":        "5678",
+					"controller": true,
+				},
+			}
+		})
+		entries := instrumentedApplicationData(item)
+		if len(entries) != 1 {
+			t.Fatalf("got %d entries, want 1", len(entries))
+		}
+		if entries[0].ControllerKind != api.KindRollout {
+			t.Errorf("controller kind = %q, want %q", entries[0].ControllerKind, api.KindRollout)
+		}
+		if !ownsWorkload(item.GetOwnerReferences(), api.KindRollout, name) {
+			t.Errorf("%s doesn't own its InstrumentedApplication", name)
+		}
+		if len(entries[0].Warnings) != 0 {
+			t.Errorf("warnings = %q", entries[0].Warnings)
+		}
+	}
+}
+
+// pagedApplications serves a custom resource per name in pages, with the namespace and language of the name.
+// The continue token is the index of the next custom resource. It records the options of every page.
+func pagedApplications(namespaces map[string]string, names []string, languages map[string]string) (pageLister, *[]v1.ListOptions) {
+	var items []*unstructured.Unstructured
+	for _, name := range names {
+		name := name
+		items = append(items, instrumentedApplicationFixture(func(object map[string]interface{}) {
+			metadata := object["metadata"].(map[string]interface{})
+			metadata["name"] = name
+			metadata["namespace"] = namespaces[name]
+			metadata["ownerReferences"].([]interface{})[0].(map[string]interface{})["name"] = name
+			object["spec"].(map[string]interface{})["languages"] = []interface{}{
+				map[string]interface{}{"containerName": name, "language": languages[name]},
+			}
+		}))
+	}
+	var requests []v1.ListOptions
+	return func(ctx context.Context, namespace string, options v1.ListOptions) ([]*unstructured.Unstructured, string, error) {
+		requests = append(requests, options)
+		start := 0
+		if options.Continue != "" {
+			start, _ = strconv.Atoi(options.Continue)
+		}
+		end := len(items)
+		if options.Limit > 0 && start+int(options.Limit) < end {
+			end = start + int(options.Limit)
+		}
+		if end == len(items) {
+			return items[start:end], "", nil
+		}
+		return items[start:end], strconv.Itoa(end), nil
+	}, &requests
+}
+
+// collectPage collects a page of the state for the query and returns the names of its entries and its continue token
+func collectPage(t *testing.T, listPage pageLister, query url.Values) ([]string, string) {
+	t.Helper()
+	filter, err := parseStateFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := newStateCollector(context.Background(), api.InitLogger(), filter)
+	continueToken, err := collector.listPages(listPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := collector.data()
+	var names []string
+	for _, entry := range data {
+		names = append(names, entry.Name)
+	}
+	return names, continueToken
+}
+
+func TestListPagesCollectsTheLimit(t *testing.T) {
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	namespaces := map[string]string{"a": "shop", "b": "shop", "c": "shop", "d": "shop", "e": "shop", "f": "shop"}
+	languages := map[string]string{"a": "java", "b": "python", "c": "python", "d": "java", "e": "java", "f": "python"}
+	listPage, requests := pagedApplications(namespaces, names, languages)
+
+	// The pages only list the missing number of custom resources until the limit matches
+	entries, continueToken := collectPage(t, listPage, url.Values{QueryLanguage: {"java"}, QueryLimit: {"2"}})
+	if !reflect.DeepEqual(entries, []string{"a", "d"}) || continueToken != "4" {
+		t.Errorf("entries = %q, continue = %q, want a and d with the continue token of e", entries, continueToken)
+	}
+	want := []v1.ListOptions{{Limit: 2}, {Limit: 1, Continue: "2"}, {Limit: 1, Continue: "3"}}
+	if !reflect.DeepEqual(*requests, want) {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+
+	// The last page is short and has no continue token
+	*requests = nil
+	entries, continueToken = collectPage(t, listPage, url.Values{QueryLanguage: {"java"}, QueryLimit: {"2"}, QueryContinue: {continueToken}})
+	if !reflect.DeepEqual(entries, []string{"e"}) || continueToken != "" {
+		t.Errorf("entries = %q, continue = %q, want e on the last page", entries, continueToken)
+	}
+	if want := []v1.ListOptions{{Limit: 2, Continue: "4"}}; !reflect.DeepEqual(*requests, want) {
+		t.Errorf("requests = %+v, want %+v", *requests, want)
+	}
+}
+
+func TestListPagesSkipsForbiddenNamespaces(t *testing.T) {
+	failing := false
+	useAccessReviews(t, &failing)
+	names := []string{"a", "b", "c", "d"}
+	namespaces := map[string]string{"a": "db", "b": "shop", "c": "db", "d": "shop"}
+	languages := map[string]string{"a": "java", "b": "java", "c": "java", "d": "java"}
+	listPage, _ := pagedApplications(namespaces, names, languages)
+
+	filter, err := parseStateFilter(url.Values{QueryLimit: {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := newStateCollector(auth.WithUser(context.Background(), &auth.User{Name: "alice"}), api.InitLogger(), filter)
+	continueToken, err := collector.listPages(listPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, collected := collector.data()
+	if collected != 2 || len(data) != 2 || data[0].Name != "b" || data[1].Name != "d" || continueToken != "" {
+		t.Errorf("entries = %+v, continue = %q, want b and d of the shop namespace", data, continueToken)
+	}
+}
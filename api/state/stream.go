@@ -0,0 +1,170 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"time"
+)
+
+const (
+	// heartbeatInterval is how often a comment line is written to idle streams so proxies keep the connection open
+	heartbeatInterval = 15 * time.Second
+	// LastEventIDHeader is sent by SSE clients on reconnect with the resourceVersion of the last received event
+	LastEventIDHeader = "Last-Event-ID"
+	EventAdded        = "added"
+	EventModified     = "modified"
+	EventDeleted      = "deleted"
+	EventError        = "error"
+)
+
+// streamEventTypes maps watch event types to the SSE event names sent to the client
+var streamEventTypes = map[watch.EventType]string{
+	watch.Added:    EventAdded,
+	watch.Modified: EventModified,
+	watch.Deleted:  EventDeleted,
+}
+
+// StreamCustomResourcesHandler streams changes to InstrumentedApplication custom resources as Server-Sent Events.
+// Each event carries the resourceVersion of the custom resource as its id and a JSON array of InstrumentdApplicationData.
+// Clients reconnecting with a Last-Event-ID header resume the watch from that resourceVersion,
+// clients without it first receive an added event without an id for every existing custom resource, followed by
+// the resourceVersion of the listing.
+// When authorization is enabled, the events of namespaces the caller cannot list are left out.
+func StreamCustomResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := api.InitLogger()
+	defer logger.Sync()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error(api.ErrorStreamingUnsupported)
+		http.Error(w, api.ErrorStreamingUnsupported, http.StatusInternalServerError)
+		return
+	}
+	if dynamicClient == nil {
+		logger.Error(api.ErrorDynamic)
+		http.Error(w, api.ErrorDynamic, http.StatusInternalServerError)
+		return
+	}
+	// Without a resume position the existing custom resources are listed first. Their resourceVersions are not
+	// ordered, so the listing events have no id and the list's resourceVersion is sent once the listing is done.
+	resourceVersion := r.Header.Get(LastEventIDHeader)
+	listed := resourceVersion == ""
+	var existing []unstructured.Unstructured
+	if listed {
+		list, err := dynamicClient.Resource(InstrumentedApplicationGVR).Namespace("").List(r.Context(), v1.ListOptions{})
+		if err != nil {
+			logger.Error(api.ErrorList, zap.Error(err))
+			http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		existing, resourceVersion = list.Items, list.GetResourceVersion()
+	}
+	watcher, err := dynamicClient.Resource(InstrumentedApplicationGVR).Namespace("").Watch(r.Context(), v1.ListOptions{
+		ResourceVersion:     resourceVersion,
+		AllowWatchBookmarks: true,
+	})
+	if err != nil {
+		logger.Error(api.ErrorWatch, zap.Error(err))
+		// The requested resourceVersion is too old, the client has to start over without Last-Event-ID
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			http.Error(w, api.ErrorWatch+err.Error(), http.StatusGone)
+			return
+		}
+		http.Error(w, api.ErrorWatch+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer watcher.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Disable response buffering in nginx based proxies
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	resolver := newCronJobResolver()
+	access := newNamespaceAccess(r.Context())
+	// send writes the event of a custom resource, an empty id doesn't change the client's Last-Event-ID
+	send := func(item *unstructured.Unstructured, id string, event string) {
+		if api.IsInternalResource(item.GetName()) {
+			return
+		}
+		// Skip the namespaces the caller cannot list
+		if allowed, err := access.allows(item.GetNamespace()); err != nil || !allowed {
+			if err != nil {
+				logger.Error(api.ErrorForbidden, zap.Error(err))
+			}
+			return
+		}
+		entries := instrumentedApplicationData(item)
+		if err := resolver.resolve(r.Context(), item, entries); err != nil {
+			logger.Warnw(api.ErrorGet, "name", item.GetName(), "namespace", item.GetNamespace(), "error", err)
+		}
+		if err := writeStreamEvent(w, id, event, entries); err != nil {
+			logger.Error(api.ErrorEncodeJSON, zap.Error(err))
+			return
+		}
+		flusher.Flush()
+	}
+	if listed {
+		for i := range existing {
+			send(&existing[i], "", EventAdded)
+		}
+		fmt.Fprintf(w, "id: %s\n\n", resourceVersion)
+		flusher.Flush()
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, ok := <-watcher.ResultChan():
+			// The watch was closed by the API server, the client reconnects with its Last-Event-ID
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case watch.Bookmark:
+				// Advance the client's Last-Event-ID without dispatching an event
+				if item, ok := event.Object.(*unstructured.Unstructured); ok {
+					fmt.Fprintf(w, "id: %s\n\n", item.GetResourceVersion())
+					flusher.Flush()
+				}
+			case watch.Error:
+				status := apierrors.FromObject(event.Object)
+				logger.Error(api.ErrorWatch, zap.Error(status))
+				writeStreamEvent(w, "", EventError, map[string]string{"error": status.Error()})
+				flusher.Flush()
+				return
+			default:
+				if item, ok := event.Object.(*unstructured.Unstructured); ok {
+					send(item, item.GetResourceVersion(), streamEventTypes[event.Type])
+				}
+			}
+		}
+	}
+}
+
+// writeStreamEvent writes a single Server-Sent Event with a JSON encoded payload
+func writeStreamEvent(w http.ResponseWriter, id string, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,158 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// streamEvent is a Server-Sent Event of the stream, with the names of its entries or its error
+type streamEvent struct {
+	id    string
+	event string
+	names string
+}
+
+// application returns an InstrumentedApplication of a deployment with the given name and resourceVersion
+func application(name string, resourceVersion string) *unstructured.Unstructured {
+	item := instrumentedApplicationFixture(nil)
+	item.SetName(name)
+	item.SetResourceVersion(resourceVersion)
+	return item
+}
+
+// useFakeWatch makes the stream list the given custom resources at resourceVersion 100 and watch the returned
+// watcher. It returns the recorded verbs and the resourceVersion of the watch.
+func useFakeWatch(t *testing.T, items ...*unstructured.Unstructured) (*watch.FakeWatcher, *[]string, *string) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		InstrumentedApplicationGVR: "InstrumentedApplicationList",
+	})
+	var verbs []string
+	var watchedVersion string
+	client.PrependReactor("list", ResourceInstrumentedApplication, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		verbs = append(verbs, "list")
+		list := &unstructured.UnstructuredList{}
+		list.SetResourceVersion("100")
+		for _, item := range items {
+			list.Items = append(list.Items, *item)
+		}
+		return true, list, nil
+	})
+	watcher := watch.NewFakeWithChanSize(10, false)
+	client.PrependWatchReactor(ResourceInstrumentedApplication, func(action k8stesting.Action) (bool, watch.Interface, error) {
+		verbs = append(verbs, "watch")
+		watchedVersion = action.(k8stesting.WatchAction).GetWatchRestrictions().ResourceVersion
+		return true, watcher, nil
+	})
+	previous := dynamicClient
+	dynamicClient = client
+	t.Cleanup(func() {
+		dynamicClient = previous
+	})
+	return watcher, &verbs, &watchedVersion
+}
+
+// readStream requests the stream with the given Last-Event-ID and parses its events until the server closes it
+func readStream(t *testing.T, lastEventID string) []streamEvent {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(StreamCustomResourcesHandler))
+	defer server.Close()
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if lastEventID != "" {
+		request.Header.Set(LastEventIDHeader, lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []streamEvent
+	for _, block := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		var event streamEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				if event.event == EventError {
+					var payload map[string]string
+					json.Unmarshal([]byte(value), &payload)
+					event.names = payload["error"]
+					continue
+				}
+				var entries []InstrumentdApplicationData
+				json.Unmarshal([]byte(value), &entries)
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name)
+				}
+				event.names = strings.Join(names, ",")
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestStreamCustomResources(t *testing.T) {
+	watcher, verbs, watchedVersion := useFakeWatch(t, application("payments", "90"), application("cart", "40"))
+	watcher.Add(application("checkout", "101"))
+	watcher.Modify(application("payments", "102"))
+	watcher.Delete(application("cart", "103"))
+	watcher.Action(watch.Bookmark, application("", "104"))
+	watcher.Error(&v1.Status{Status: v1.StatusFailure, Code: http.StatusGone, Reason: v1.StatusReasonExpired, Message: "too old resource version"})
+	watcher.Add(application("ignored", "105"))
+
+	events := readStream(t, "")
+	want := []streamEvent{
+		// The listing has no ids, its resourceVersion follows it
+		{event: EventAdded, names: "payments"},
+		{event: EventAdded, names: "cart"},
+		{id: "100"},
+		{id: "101", event: EventAdded, names: "checkout"},
+		{id: "102", event: EventModified, names: "payments"},
+		{id: "103", event: EventDeleted, names: "cart"},
+		{id: "104"},
+		// The error ends the stream
+		{event: EventError, names: "too old resource version"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %+v, want %+v", events, want)
+	}
+	if !reflect.DeepEqual(*verbs, []string{"list", "watch"}) || *watchedVersion != "100" {
+		t.Errorf("verbs = %v, watched version = %q, want a watch from the listing", *verbs, *watchedVersion)
+	}
+}
+
+func TestStreamCustomResourcesResumes(t *testing.T) {
+	watcher, verbs, watchedVersion := useFakeWatch(t, application("payments", "90"))
+	watcher.Modify(application("payments", "201"))
+	watcher.Stop()
+
+	events := readStream(t, "200")
+	if want := []streamEvent{{id: "201", event: EventModified, names: "payments"}}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %+v, want %+v", events, want)
+	}
+	if !reflect.DeepEqual(*verbs, []string{"watch"}) || *watchedVersion != "200" {
+		t.Errorf("verbs = %v, watched version = %q, want a watch from the Last-Event-ID", *verbs, *watchedVersion)
+	}
+}
@@ -0,0 +1,45 @@
+package state
+
+import (
+	"github.com/logzio/ezkonnect-server/api"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Summary counts the cached InstrumentedApplication custom resources
+// InstrumentedByLanguage: custom resources of instrumented workloads by detected language, a workload with several languages is counted once per language
+// ByDetectionPhase: custom resources by detection phase
+type Summary struct {
+	InstrumentedByLanguage map[string]int
+	ByDetectionPhase       map[string]int
+}
+
+// Summarize counts the cached InstrumentedApplication custom resources, skipping ezkonnect's own workloads.
+// It returns ErrCacheNotSynced until the cache has synced.
+func Summarize() (Summary, error) {
+	summary := Summary{InstrumentedByLanguage: map[string]int{}, ByDetectionPhase: map[string]int{}}
+	if !HasSynced() {
+		return summary, ErrCacheNotSynced
+	}
+	items, err := listInstrumentedApplications("", labels.Everything())
+	if err != nil {
+		return summary, err
+	}
+	for _, item := range items {
+		if api.IsInternalResource(item.GetName()) {
+			continue
+		}
+		application, _ := decodeInstrumentedApplication(item)
+		summary.ByDetectionPhase[application.Status.InstrumentationDetection.Phase]++
+		if !application.Status.TracesInstrumented {
+			continue
+		}
+		counted := map[string]bool{}
+		for _, language := range application.Spec.Languages {
+			if language.Language != "" && !counted[language.Language] {
+				counted[language.Language] = true
+				summary.InstrumentedByLanguage[language.Language]++
+			}
+		}
+	}
+	return summary, nil
+}
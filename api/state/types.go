@@ -0,0 +1,187 @@
+package state
+
+import (
+	"fmt"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DetectionPhasePending is reported for custom resources that have no detection status yet
+const DetectionPhasePending = "pending"
+
+// knownDetectionPhases are the detection phases set by the instrumentor, other phases are reported as warnings
+var knownDetectionPhases = []string{DetectionPhaseCompleted, "Running", "error"}
+
+// InstrumentedApplication is the typed form of the InstrumentedApplication custom resource
+type InstrumentedApplication struct {
+	v1.TypeMeta   `json:",inline"`
+	v1.ObjectMeta `json:"metadata,omitempty"`
+	Spec          InstrumentedApplicationSpec   `json:"spec,omitempty"`
+	Status        InstrumentedApplicationStatus `json:"status,omitempty"`
+}
+
+// InstrumentedApplicationSpec holds the detection results of the workload's containers
+// languages: containers with a detected programming language
+// applications: containers with a detected application
+// logType: the log type of the workload
+type InstrumentedApplicationSpec struct {
+	Languages    []LanguageSpec    `json:"languages,omitempty"`
+	Applications []ApplicationSpec `json:"applications,omitempty"`
+	LogType      string            `json:"logType,omitempty"`
+}
+
+// LanguageSpec is a container with a detected programming language
+type LanguageSpec struct {
+	ContainerName              string `json:"containerName,omitempty"`
+	Language                   string `json:"language,omitempty"`
+	OpentelemetryPreconfigured bool   `json:"opentelemetryPreconfigured,omitempty"`
+}
+
+// ApplicationSpec is a container with a detected application
+type ApplicationSpec struct {
+	ContainerName string `json:"containerName,omitempty"`
+	Application   string `json:"application,omitempty"`
+}
+
+// InstrumentedApplicationStatus is the instrumentation state reported by the instrumentor
+type InstrumentedApplicationStatus struct {
+	TracesInstrumented       bool                           `json:"tracesInstrumented,omitempty"`
+	InstrumentationDetection InstrumentationDetectionStatus `json:"instrumentationDetection,omitempty"`
+}
+
+// InstrumentationDetectionStatus is the state of the detection process
+type InstrumentationDetectionStatus struct {
+	Phase string `json:"phase,omitempty"`
+}
+
+// decodeInstrumentedApplication converts an unstructured InstrumentedApplication to its typed form.
+// Malformed fields are skipped instead of failing the whole object, and every skipped or
+// missing field is reported as a warning.
+func decodeInstrumentedApplication(item *unstructured.Unstructured) (InstrumentedApplication, []string) {
+	var application InstrumentedApplication
+	var warnings []string
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &application); err != nil {
+		// Decode field by field so a single malformed field doesn't hide the rest of the object
+		application = InstrumentedApplication{}
+		application.ObjectMeta = v1.ObjectMeta{
+			Name:            item.GetName(),
+			Namespace:       item.GetNamespace(),
+			UID:             item.GetUID(),
+			ResourceVersion: item.GetResourceVersion(),
+			Labels:          item.GetLabels(),
+			OwnerReferences: item.GetOwnerReferences(),
+		}
+		if spec, ok := item.Object["spec"].(map[string]interface{}); ok {
+			warnings = append(warnings, decodeFields(spec, &application.Spec, "spec")...)
+		} else if _, found := item.Object["spec"]; found {
+			warnings = append(warnings, "ignoring spec: not an object")
+		}
+		if status, ok := item.Object["status"].(map[string]interface{}); ok {
+			warnings = append(warnings, decodeFields(status, &application.Status, "status")...)
+		} else if _, found := item.Object["status"]; found {
+			warnings = append(warnings, "ignoring status: not an object")
+		}
+	}
+
+	if len(item.GetOwnerReferences()) == 0 {
+		warnings = append(warnings, "missing owner reference, controller kind is unknown")
+	}
+	if application.Spec.LogType == "" {
+		warnings = append(warnings, "missing spec.logType")
+	}
+	if application.Status.InstrumentationDetection.Phase == "" {
+		warnings = append(warnings, "missing status.instrumentationDetection.phase, detection has not started yet")
+		application.Status.InstrumentationDetection.Phase = DetectionPhasePending
+	} else if !isKnownDetectionPhase(application.Status.InstrumentationDetection.Phase) {
+		warnings = append(warnings, fmt.Sprintf("unknown status.instrumentationDetection.phase %q", application.Status.InstrumentationDetection.Phase))
+	}
+	for i, language := range application.Spec.Languages {
+		if language.ContainerName == "" {
+			warnings = append(warnings, fmt.Sprintf("missing spec.languages[%d].containerName", i))
+		}
+	}
+	for i, app := range application.Spec.Applications {
+		if app.ContainerName == "" {
+			warnings = append(warnings, fmt.Sprintf("missing spec.applications[%d].containerName", i))
+		}
+	}
+	return application, warnings
+}
+
+// isKnownDetectionPhase reports whether phase is one of knownDetectionPhases
+func isKnownDetectionPhase(phase string) bool {
+	for _, known := range knownDetectionPhases {
+		if phase == known {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeFields decodes each field of an unstructured object into the struct pointed to by into,
+// skipping the fields that cannot be converted. The elements of list fields are decoded one by one,
+// so a malformed element only skips that element. path is the field path used in the warnings.
+func decodeFields(fields map[string]interface{}, into interface{}, path string) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var warnings []string
+	valid := map[string]interface{}{}
+	for _, key := range keys {
+		field := map[string]interface{}{key: fields[key]}
+		// Try each field on a scratch value so a failed conversion doesn't leave partial data behind
+		scratch := reflect.New(reflect.TypeOf(into).Elem()).Interface()
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(field, scratch); err != nil {
+			elements, ok := fields[key].([]interface{})
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("ignoring %s.%s: %v", path, key, err))
+				continue
+			}
+			validElements := []interface{}{}
+			for i, element := range elements {
+				scratch := reflect.New(reflect.TypeOf(into).Elem()).Interface()
+				if err := runtime.DefaultUnstructuredConverter.FromUnstructured(map[string]interface{}{key: []interface{}{element}}, scratch); err != nil {
+					warnings = append(warnings, fmt.Sprintf("ignoring %s.%s[%d]: %v", path, key, i, err))
+					continue
+				}
+				validElements = append(validElements, element)
+			}
+			valid[key] = validElements
+			continue
+		}
+		valid[key] = fields[key]
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(valid, into); err != nil {
+		warnings = append(warnings, fmt.Sprintf("ignoring %s: %v", path, err))
+	}
+	return warnings
+}
+
+// controllerKind returns the lowercased kind of the controller owning the custom resource,
+// or an empty string when the custom resource has no owner
+func (application InstrumentedApplication) controllerKind() string {
+	owner := application.controllerReference()
+	if owner == nil {
+		return ""
+	}
+	return strings.ToLower(owner.Kind)
+}
+
+// controllerReference returns the managing controller of the custom resource,
+// falling back to the first owner reference when none is marked as controller
+func (application InstrumentedApplication) controllerReference() *v1.OwnerReference {
+	if owner := v1.GetControllerOfNoCopy(&application); owner != nil {
+		return owner
+	}
+	if len(application.OwnerReferences) > 0 {
+		return &application.OwnerReferences[0]
+	}
+	return nil
+}
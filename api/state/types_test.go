@@ -0,0 +1,217 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// instrumentedApplicationFixture returns an InstrumentedApplication owned by a deployment,
+// modify changes its content before it is decoded
+func instrumentedApplicationFixture(modify func(object map[string]interface{})) *unstructured.Unstructured {
+	object := map[string]interface{}{
+		"apiVersion": "logz.io/v1alpha1",
+		"kind":       "InstrumentedApplication",
+		"metadata": map[string]interface{}{
+			"name":      "deployment-app",
+			"namespace": "default",
+			"ownerReferences": []interface{}{
+				map[string]interface{}{
+					"apiVersion": "apps/v1",
+					"kind":       "Deployment",
+					"name":       "app",
+					"uid":        "1234",
+					"controller": true,
+				},
+			},
+		},
+		"spec": map[string]interface{}{
+			"languages": []interface{}{
+				map[string]interface{}{"containerName": "app", "language": "java"},
+			},
+			"logType": "log",
+		},
+		"status": map[string]interface{}{
+			"tracesInstrumented": true,
+			"instrumentationDetection": map[string]interface{}{
+				"phase": "Completed",
+			},
+		},
+	}
+	if modify != nil {
+		modify(object)
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func TestDecodeInstrumentedApplication(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(object map[string]interface{})
+		// expected decoded fields
+		controllerKind     string
+		logType            string
+		phase              string
+		tracesInstrumented bool
+		languages          []LanguageSpec
+		// expected warnings, a warning ending with "*" only has to match its prefix
+		warnings []string
+	}{
+		{
+			name:               "valid",
+			controllerKind:     "deployment",
+			logType:            "log",
+			phase:              "Completed",
+			tracesInstrumented: true,
+			languages:          []LanguageSpec{{ContainerName: "app", Language: "java"}},
+		},
+		{
+			name: "no owner reference",
+			modify: func(object map[string]interface{}) {
+				delete(object["metadata"].(map[string]interface{}), "ownerReferences")
+			},
+			logType:            "log",
+			phase:              "Completed",
+			tracesInstrumented: true,
+			languages:          []LanguageSpec{{ContainerName: "app", Language: "java"}},
+			warnings:           []string{"missing owner reference, controller kind is unknown"},
+		},
+		{
+			name: "no status",
+			modify: func(object map[string]interface{}) {
+				delete(object, "status")
+			},
+			controllerKind: "deployment",
+			logType:        "log",
+			phase:          DetectionPhasePending,
+			languages:      []LanguageSpec{{ContainerName: "app", Language: "java"}},
+			warnings:       []string{"missing status.instrumentationDetection.phase, detection has not started yet"},
+		},
+		{
+			name: "status is not an object",
+			modify: func(object map[string]interface{}) {
+				object["status"] = "ready"
+			},
+			controllerKind: "deployment",
+			logType:        "log",
+			phase:          DetectionPhasePending,
+			languages:      []LanguageSpec{{ContainerName: "app", Language: "java"}},
+			warnings: []string{
+				"ignoring status: not an object",
+				"missing status.instrumentationDetection.phase, detection has not started yet",
+			},
+		},
+		{
+			name: "non-string logType",
+			modify: func(object map[string]interface{}) {
+				object["spec"].(map[string]interface{})["logType"] = int64(3)
+			},
+			controllerKind:     "deployment",
+			phase:              "Completed",
+			tracesInstrumented: true,
+			languages:          []LanguageSpec{{ContainerName: "app", Language: "java"}},
+			warnings: []string{
+				"ignoring spec.logType: *",
+				"missing spec.logType",
+			},
+		},
+		{
+			name: "bad languages entry",
+			modify: func(object map[string]interface{}) {
+				object["spec"].(map[string]interface{})["languages"] = []interface{}{
+					"java",
+					map[string]interface{}{"containerName": "app", "language": "java"},
+					map[string]interface{}{"language": "python"},
+				}
+			},
+			controllerKind:     "deployment",
+			logType:            "log",
+			phase:              "Completed",
+			tracesInstrumented: true,
+			languages: []LanguageSpec{
+				{ContainerName: "app", Language: "java"},
+				{Language: "python"},
+			},
+			warnings: []string{
+				"ignoring spec.languages[0]: *",
+				"missing spec.languages[1].containerName",
+			},
+		},
+		{
+			name: "unknown phase",
+			modify: func(object map[string]interface{}) {
+				object["status"].(map[string]interface{})["instrumentationDetection"] = map[string]interface{}{"phase": "Exploding"}
+			},
+			controllerKind:     "deployment",
+			logType:            "log",
+			phase:              "Exploding",
+			tracesInstrumented: true,
+			languages:          []LanguageSpec{{ContainerName: "app", Language: "java"}},
+			warnings:           []string{`unknown status.instrumentationDetection.phase "Exploding"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			application, warnings := decodeInstrumentedApplication(instrumentedApplicationFixture(test.modify))
+			if application.Name != "deployment-app" || application.Namespace != "default" {
+				t.Errorf("metadata = %s/%s, want default/deployment-app", application.Namespace, application.Name)
+			}
+			if kind := application.controllerKind(); kind != test.controllerKind {
+				t.Errorf("controller kind = %q, want %q", kind, test.controllerKind)
+			}
+			if application.Spec.LogType != test.logType {
+				t.Errorf("log type = %q, want %q", application.Spec.LogType, test.logType)
+			}
+			if phase := application.Status.InstrumentationDetection.Phase; phase != test.phase {
+				t.Errorf("phase = %q, want %q", phase, test.phase)
+			}
+			if application.Status.TracesInstrumented != test.tracesInstrumented {
+				t.Errorf("traces instrumented = %v, want %v", application.Status.TracesInstrumented, test.tracesInstrumented)
+			}
+			if !reflect.DeepEqual(application.Spec.Languages, test.languages) {
+				t.Errorf("languages = %+v, want %+v", application.Spec.Languages, test.languages)
+			}
+			if !matchWarnings(warnings, test.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, test.warnings)
+			}
+		})
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	var spec InstrumentedApplicationSpec
+	warnings := decodeFields(map[string]interface{}{
+		"logType":      true,
+		"applications": []interface{}{map[string]interface{}{"containerName": "db", "application": "postgres"}},
+		"languages":    []interface{}{map[string]interface{}{"containerName": 1}},
+	}, &spec, "spec")
+	want := InstrumentedApplicationSpec{
+		Applications: []ApplicationSpec{{ContainerName: "db", Application: "postgres"}},
+		Languages:    []LanguageSpec{},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("spec = %+v, want %+v", spec, want)
+	}
+	if !matchWarnings(warnings, []string{"ignoring spec.languages[0]: *", "ignoring spec.logType: *"}) {
+		t.Errorf("warnings = %q", warnings)
+	}
+}
+
+// matchWarnings compares warnings in order, an expected warning ending with "*" only has to match its prefix
+func matchWarnings(warnings []string, expected []string) bool {
+	if len(warnings) != len(expected) {
+		return false
+	}
+	for i, warning := range warnings {
+		if prefix := strings.TrimSuffix(expected[i], "*"); prefix != expected[i] {
+			if !strings.HasPrefix(warning, prefix) {
+				return false
+			}
+		} else if warning != expected[i] {
+			return false
+		}
+	}
+	return true
+}
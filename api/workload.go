@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/client-go/util/retry"
+	"strings"
+)
+
+// Clients are the Kubernetes clients used to access workloads
+type Clients struct {
+	Kube    kubernetes.Interface
+	Dynamic dynamic.Interface
+}
+
+// WorkloadAccessor reads and patches the pod template annotations of a workload kind.
+// New workload kinds are supported by registering an accessor with RegisterWorkloadKind.
+type WorkloadAccessor interface {
+	// Get fetches the workload
+	Get(ctx context.Context, clients Clients, namespace string, name string) (runtime.Object, error)
+	// PodTemplateAnnotations returns the pod template annotations of a fetched workload
+	PodTemplateAnnotations(object runtime.Object) map[string]string
+	// AnnotationsPath returns the fields leading to the pod template annotations,
+	// for example []string{"spec", "template", "metadata", "annotations"}
+	AnnotationsPath() []string
+	// GroupResource returns the API group and resource of the workload kind, for example apps and deployments
+	GroupResource() schema.GroupResource
+	// Patch applies a patch to the workload
+	Patch(ctx context.Context, clients Clients, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error
+}
+
+// WorkloadResolver is implemented by accessors of kinds that are managed through another workload,
+// such as jobs created by a CronJob
+type WorkloadResolver interface {
+	// Resolve returns the kind and name of the workload that manages the given workload,
+	// or the given kind and name when it is not managed by another workload
+	Resolve(ctx context.Context, clients Clients, namespace string, name string) (string, string, error)
+}
+
+// RolloutChecker is implemented by accessors of kinds whose pod template changes don't always replace the running pods
+type RolloutChecker interface {
+	// TemplateChangeTriggersRollout reports whether changing the pod template of a fetched workload replaces its running pods
+	TemplateChangeTriggersRollout(object runtime.Object) bool
+}
+
+// WorkloadLister is implemented by accessors of kinds that can be selected by labels
+type WorkloadLister interface {
+	// List returns the names of the workloads in a namespace that match a label selector
+	List(ctx context.Context, clients Clients, namespace string, labelSelector string) ([]string, error)
+}
+
+// ErrLabelSelectionUnsupported is returned when listing a workload kind that can't be selected by labels
+var ErrLabelSelectionUnsupported = errors.New("kind can't be selected by labels")
+
+// workloadAccessors is the registry of supported workload kinds
+var workloadAccessors = map[string]WorkloadAccessor{}
+
+// RegisterWorkloadKind adds a workload kind to the registry and to ValidKinds.
+// Registering a kind again replaces its accessor.
+func RegisterWorkloadKind(kind string, accessor WorkloadAccessor) {
+	kind = strings.ToLower(kind)
+	if _, exists := workloadAccessors[kind]; !exists {
+		ValidKinds = append(ValidKinds, kind)
+	}
+	workloadAccessors[kind] = accessor
+}
+
+// GetWorkloadAccessor returns the accessor registered for a workload kind
+func GetWorkloadAccessor(kind string) (WorkloadAccessor, bool) {
+	accessor, ok := workloadAccessors[strings.ToLower(kind)]
+	return accessor, ok
+}
+
+// IsValidKind reports whether a workload kind is registered
+func IsValidKind(kind string) bool {
+	_, ok := GetWorkloadAccessor(kind)
+	return ok
+}
+
+// GetWorkloadReference returns a reference to a workload, used as the involved object of Kubernetes events
+func GetWorkloadReference(ctx context.Context, clients Clients, kind string, namespace string, name string) (*corev1.ObjectReference, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	object, err := accessor.Get(ctx, clients, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	// Objects read with the typed clientset don't carry their type, the reference looks it up in the scheme
+	return reference.GetReference(scheme.Scheme, object)
+}
+
+// ResolveWorkload returns the kind and name of the workload whose pod template should be annotated
+// for the requested workload, see WorkloadResolver
+func ResolveWorkload(ctx context.Context, clients Clients, kind string, namespace string, name string) (string, string, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported kind %q", kind)
+	}
+	if resolver, ok := accessor.(WorkloadResolver); ok {
+		return resolver.Resolve(ctx, clients, namespace, name)
+	}
+	return kind, name, nil
+}
+
+// WorkloadGroupResource returns the API group and resource of a workload kind
+func WorkloadGroupResource(kind string) (schema.GroupResource, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return schema.GroupResource{}, fmt.Errorf("unsupported kind %q", kind)
+	}
+	return accessor.GroupResource(), nil
+}
+
+// ListWorkloads returns the names of the workloads of a kind in a namespace that match a label selector,
+// see WorkloadLister
+func ListWorkloads(ctx context.Context, clients Clients, kind string, namespace string, labelSelector string) ([]string, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	lister, ok := accessor.(WorkloadLister)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrLabelSelectionUnsupported, kind)
+	}
+	names, err := lister.List(ctx, clients, namespace, labelSelector)
+	if errors.Is(err, ErrLabelSelectionUnsupported) {
+		return nil, fmt.Errorf("%w: %s", ErrLabelSelectionUnsupported, kind)
+	}
+	return names, err
+}
+
+// objectNames returns the names of the items of a list object
+func objectNames(list runtime.Object) ([]string, error) {
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		metadata, err := meta.Accessor(item)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, metadata.GetName())
+	}
+	return names, nil
+}
+
+// GetPodTemplateAnnotations returns the pod template annotations of a workload
+func GetPodTemplateAnnotations(ctx context.Context, clients Clients, kind string, namespace string, name string) (map[string]string, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	object, err := accessor.Get(ctx, clients, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return accessor.PodTemplateAnnotations(object), nil
+}
+
+// UpdatePodTemplateAnnotations fetches a workload, applies mutate to its pod template annotations and patches
+// the changed annotations. mutate receives a copy of the current annotations that it can change in place.
+// The patch is conditioned on the fetched resourceVersion so the returned before and after annotations are exact,
+// and it is retried with a fresh read on conflicts. No patch is sent when mutate doesn't change the annotations.
+// It returns the annotations before and after the mutation and whether the change triggers a rollout.
+func UpdatePodTemplateAnnotations(ctx context.Context, clients Clients, kind string, namespace string, name string, mutate func(annotations map[string]string), opts v1.PatchOptions) (PodTemplateChange, error) {
+	accessor, ok := GetWorkloadAccessor(kind)
+	if !ok {
+		return PodTemplateChange{}, fmt.Errorf("unsupported kind %q", kind)
+	}
+	var change PodTemplateChange
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		object, err := accessor.Get(ctx, clients, namespace, name)
+		if err != nil {
+			return err
+		}
+		change = newPodTemplateChange(accessor, object, mutate)
+		if !change.Changed() {
+			return nil
+		}
+		metadata, err := meta.Accessor(object)
+		if err != nil {
+			return err
+		}
+		patch, err := annotationsMergePatch(accessor.AnnotationsPath(), metadata.GetResourceVersion(), change.Before, change.After)
+		if err != nil {
+			return err
+		}
+		return accessor.Patch(ctx, clients, namespace, name, types.MergePatchType, patch, opts)
+	})
+	if err != nil {
+		return PodTemplateChange{}, err
+	}
+	return change, nil
+}
+
+// PodTemplateChange is a change of the pod template annotations of a workload
+// Before: the annotations before the change
+// After: the annotations after the change
+// RolloutTriggered: whether the change replaces the workload's running pods, false when the annotations didn't change
+type PodTemplateChange struct {
+	Before           map[string]string
+	After            map[string]string
+	RolloutTriggered bool
+}
+
+// Changed reports whether the change modifies the annotations
+func (change PodTemplateChange) Changed() bool {
+	return AnnotationsChanged(change.Before, change.After)
+}
+
+// newPodTemplateChange applies mutate to a copy of the pod template annotations of a fetched workload
+func newPodTemplateChange(accessor WorkloadAccessor, object runtime.Object, mutate func(annotations map[string]string)) PodTemplateChange {
+	change := PodTemplateChange{Before: copyAnnotations(accessor.PodTemplateAnnotations(object))}
+	change.After = copyAnnotations(change.Before)
+	mutate(change.After)
+	change.RolloutTriggered = change.Changed() && templateChangeTriggersRollout(accessor, object)
+	return change
+}
+
+// annotationsMergePatch builds a JSON merge patch that changes only the annotations that differ between before and after,
+// removed annotations are set to null. A non-empty resourceVersion makes the API server reject the patch
+// with a conflict when the object changed since it was read.
+func annotationsMergePatch(annotationsPath []string, resourceVersion string, before map[string]string, after map[string]string) ([]byte, error) {
+	changes := map[string]interface{}{}
+	for k, v := range after {
+		if previous, ok := before[k]; !ok || previous != v {
+			changes[k] = v
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changes[k] = nil
+		}
+	}
+	var patch interface{} = changes
+	for i := len(annotationsPath) - 1; i >= 0; i-- {
+		patch = map[string]interface{}{annotationsPath[i]: patch}
+	}
+	if resourceVersion != "" {
+		patch.(map[string]interface{})["metadata"] = map[string]interface{}{"resourceVersion": resourceVersion}
+	}
+	return json.Marshal(patch)
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	copied := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	return copied
+}
+
+// templateChangeTriggersRollout reports whether changing the pod template of a fetched workload replaces its running pods,
+// which is assumed for kinds whose accessor doesn't implement RolloutChecker
+func templateChangeTriggersRollout(accessor WorkloadAccessor, object runtime.Object) bool {
+	checker, ok := accessor.(RolloutChecker)
+	return !ok || checker.TemplateChangeTriggersRollout(object)
+}
+
+// AnnotationsChanged reports whether two annotation maps differ
+func AnnotationsChanged(before map[string]string, after map[string]string) bool {
+	if len(before) != len(after) {
+		return true
+	}
+	for k, v := range before {
+		if value, ok := after[k]; !ok || value != v {
+			return true
+		}
+	}
+	return false
+}
+
+// DryRunResult is the preview of an annotation change that was not persisted
+// before: the pod template annotations of the workload
+// after: the pod template annotations the workload would have
+// rollout_triggered: whether the change would replace the workload's running pods
+type DryRunResult struct {
+	Before           map[string]string `json:"before"`
+	After            map[string]string `json:"after"`
+	RolloutTriggered bool              `json:"rollout_triggered"`
+}
+
+// NewDryRunResult builds the preview of an annotation change
+func NewDryRunResult(change PodTemplateChange) *DryRunResult {
+	return &DryRunResult{
+		Before:           change.Before,
+		After:            change.After,
+		RolloutTriggered: change.RolloutTriggered,
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newDeploymentClients returns fake clients holding the default/api deployment with the given pod template annotations
+func newDeploymentClients(resourceVersion string, annotations map[string]string) (Clients, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "default", ResourceVersion: resourceVersion},
+		Spec:       deploymentSpec(annotations),
+	})
+	return Clients{Kube: clientset}, clientset
+}
+
+// actionVerbs returns the verbs of the recorded actions of a fake clientset
+func actionVerbs(clientset *fake.Clientset) []string {
+	var verbs []string
+	for _, action := range clientset.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	return verbs
+}
+
+func TestUpdatePodTemplateAnnotationsRetriesConflicts(t *testing.T) {
+	clients, clientset := newDeploymentClients("1", map[string]string{"keep": "value", "removed": "value"})
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	var patches []string
+	conflicted := false
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(k8stesting.PatchAction).GetPatch()))
+		if conflicted {
+			return false, nil, nil
+		}
+		conflicted = true
+		// Another client changes the deployment between the read and the patch
+		concurrent := &appsv1.Deployment{
+			ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "default", ResourceVersion: "2"},
+			Spec:       deploymentSpec(map[string]string{"keep": "value", "removed": "value", "concurrent": "value"}),
+		}
+		if err := clientset.Tracker().Update(deployments, concurrent, "default"); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, apierrors.NewConflict(deployments.GroupResource(), "api", nil)
+	})
+
+	change, err := UpdatePodTemplateAnnotations(context.Background(), clients, KindDeployment, "default", "api", func(annotations map[string]string) {
+		annotations[InstrumentationAnnotation] = "true"
+		delete(annotations, "removed")
+	}, v1.PatchOptions{FieldManager: FieldManager})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry re-reads the deployment, so the returned annotations include the concurrent change
+	if verbs := actionVerbs(clientset); !reflect.DeepEqual(verbs, []string{"get", "patch", "get", "patch"}) {
+		t.Errorf("actions = %v, want a get and a patch per attempt", verbs)
+	}
+	wantBefore := map[string]string{"keep": "value", "removed": "value", "concurrent": "value"}
+	wantAfter := map[string]string{"keep": "value", "concurrent": "value", InstrumentationAnnotation: "true"}
+	if !reflect.DeepEqual(change.Before, wantBefore) || !reflect.DeepEqual(change.After, wantAfter) {
+		t.Errorf("before = %v, after = %v, want %v and %v", change.Before, change.After, wantBefore, wantAfter)
+	}
+	if !change.RolloutTriggered {
+		t.Error("changing the pod template of a deployment didn't trigger a rollout")
+	}
+	wantPatches := []string{
+		`{"metadata":{"resourceVersion":"1"},"spec":{"template":{"metadata":{"annotations":{"logz.io/traces_instrument":"true","removed":null}}}}}`,
+		`{"metadata":{"resourceVersion":"2"},"spec":{"template":{"metadata":{"annotations":{"logz.io/traces_instrument":"true","removed":null}}}}}`,
+	}
+	if !reflect.DeepEqual(patches, wantPatches) {
+		t.Errorf("patches = %q, want %q", patches, wantPatches)
+	}
+	deployment, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "api", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations := deployment.Spec.Template.Annotations; !reflect.DeepEqual(annotations, wantAfter) {
+		t.Errorf("deployment annotations = %v, want %v", annotations, wantAfter)
+	}
+}
+
+func TestUpdatePodTemplateAnnotationsSkipsNoOpChanges(t *testing.T) {
+	clients, clientset := newDeploymentClients("1", map[string]string{InstrumentationAnnotation: "true"})
+	change, err := UpdatePodTemplateAnnotations(context.Background(), clients, KindDeployment, "default", "api", func(annotations map[string]string) {
+		annotations[InstrumentationAnnotation] = "true"
+	}, v1.PatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verbs := actionVerbs(clientset); !reflect.DeepEqual(verbs, []string{"get"}) {
+		t.Errorf("actions = %v, want no patch", verbs)
+	}
+	if change.Changed() || change.RolloutTriggered {
+		t.Errorf("change = %+v, want no change", change)
+	}
+}
+
+func TestUpdatePodTemplateAnnotationsGivesUpOnOtherErrors(t *testing.T) {
+	clients, clientset := newDeploymentClients("1", nil)
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, "api", nil)
+	})
+	_, err := UpdatePodTemplateAnnotations(context.Background(), clients, KindDeployment, "default", "api", func(annotations map[string]string) {
+		annotations[LogTypeAnnotation] = "log"
+	}, v1.PatchOptions{})
+	if !apierrors.IsForbidden(err) {
+		t.Errorf("error = %v, want Forbidden", err)
+	}
+	if verbs := actionVerbs(clientset); !reflect.DeepEqual(verbs, []string{"get", "patch"}) {
+		t.Errorf("actions = %v, want a single attempt", verbs)
+	}
+}
+
+func TestAnnotationsMergePatch(t *testing.T) {
+	tests := []struct {
+		name            string
+		resourceVersion string
+		before          map[string]string
+		after           map[string]string
+		expected        string
+	}{
+		{
+			name:     "added and changed",
+			before:   map[string]string{"same": "1", "changed": "1"},
+			after:    map[string]string{"same": "1", "changed": "2", "added": "3"},
+			expected: `{"spec":{"template":{"metadata":{"annotations":{"added":"3","changed":"2"}}}}}`,
+		},
+		{
+			name:            "removed with a resource version",
+			resourceVersion: "42",
+			before:          map[string]string{"removed": "1"},
+			after:           map[string]string{},
+			expected:        `{"metadata":{"resourceVersion":"42"},"spec":{"template":{"metadata":{"annotations":{"removed":null}}}}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := annotationsMergePatch([]string{"spec", "template", "metadata", "annotations"}, test.resourceVersion, test.before, test.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != test.expected {
+				t.Errorf("patch = %s, want %s", patch, test.expected)
+			}
+		})
+	}
+}
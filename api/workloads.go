@@ -0,0 +1,303 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+func init() {
+	RegisterWorkloadKind(KindDeployment, TypedWorkloadAccessor{
+		Resource: schema.GroupResource{Group: "apps", Resource: "deployments"},
+		GetFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error) {
+			return clientset.AppsV1().Deployments(namespace).Get(ctx, name, v1.GetOptions{})
+		},
+		ListFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, opts v1.ListOptions) (runtime.Object, error) {
+			return clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+		},
+		PatchFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+			_, err := clientset.AppsV1().Deployments(namespace).Patch(ctx, name, patchType, data, opts)
+			return err
+		},
+		PodTemplateFunc: func(object runtime.Object) *corev1.PodTemplateSpec {
+			return &object.(*appsv1.Deployment).Spec.Template
+		},
+		RolloutFunc: func(object runtime.Object) bool {
+			// Paused deployments roll the change out when they are resumed
+			return !object.(*appsv1.Deployment).Spec.Paused
+		},
+		TemplatePath: []string{"spec", "template"},
+	})
+	RegisterWorkloadKind(KindStatefulSet, TypedWorkloadAccessor{
+		Resource: schema.GroupResource{Group: "apps", Resource: "statefulsets"},
+		GetFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error) {
+			return clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, v1.GetOptions{})
+		},
+		ListFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, opts v1.ListOptions) (runtime.Object, error) {
+			return clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+		},
+		PatchFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+			_, err := clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, patchType, data, opts)
+			return err
+		},
+		PodTemplateFunc: func(object runtime.Object) *corev1.PodTemplateSpec {
+			return &object.(*appsv1.StatefulSet).Spec.Template
+		},
+		RolloutFunc: func(object runtime.Object) bool {
+			// With the OnDelete strategy the pods are only replaced when they are deleted
+			return object.(*appsv1.StatefulSet).Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType
+		},
+		TemplatePath: []string{"spec", "template"},
+	})
+	RegisterWorkloadKind(KindDaemonSet, TypedWorkloadAccessor{
+		Resource: schema.GroupResource{Group: "apps", Resource: "daemonsets"},
+		GetFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error) {
+			return clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, v1.GetOptions{})
+		},
+		ListFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, opts v1.ListOptions) (runtime.Object, error) {
+			return clientset.AppsV1().DaemonSets(namespace).List(ctx, opts)
+		},
+		PatchFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+			_, err := clientset.AppsV1().DaemonSets(namespace).Patch(ctx, name, patchType, data, opts)
+			return err
+		},
+		PodTemplateFunc: func(object runtime.Object) *corev1.PodTemplateSpec {
+			return &object.(*appsv1.DaemonSet).Spec.Template
+		},
+		RolloutFunc: func(object runtime.Object) bool {
+			return object.(*appsv1.DaemonSet).Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType
+		},
+		TemplatePath: []string{"spec", "template"},
+	})
+	RegisterWorkloadKind(KindCronJob, TypedWorkloadAccessor{
+		Resource: schema.GroupResource{Group: "batch", Resource: "cronjobs"},
+		GetFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error) {
+			return clientset.BatchV1().CronJobs(namespace).Get(ctx, name, v1.GetOptions{})
+		},
+		ListFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, opts v1.ListOptions) (runtime.Object, error) {
+			return clientset.BatchV1().CronJobs(namespace).List(ctx, opts)
+		},
+		PatchFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+			_, err := clientset.BatchV1().CronJobs(namespace).Patch(ctx, name, patchType, data, opts)
+			return err
+		},
+		PodTemplateFunc: func(object runtime.Object) *corev1.PodTemplateSpec {
+			return &object.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+		},
+		RolloutFunc: func(object runtime.Object) bool {
+			// Changes only apply to the jobs of future runs
+			return false
+		},
+		TemplatePath: []string{"spec", "jobTemplate", "spec", "template"},
+	})
+	RegisterWorkloadKind(KindJob, jobWorkloadAccessor{TypedWorkloadAccessor{
+		Resource: schema.GroupResource{Group: "batch", Resource: "jobs"},
+		GetFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error) {
+			return clientset.BatchV1().Jobs(namespace).Get(ctx, name, v1.GetOptions{})
+		},
+		PatchFunc: func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+			_, err := clientset.BatchV1().Jobs(namespace).Patch(ctx, name, patchType, data, opts)
+			return err
+		},
+		PodTemplateFunc: func(object runtime.Object) *corev1.PodTemplateSpec {
+			return &object.(*batchv1.Job).Spec.Template
+		},
+		RolloutFunc: func(object runtime.Object) bool {
+			return false
+		},
+		TemplatePath: []string{"spec", "template"},
+	}})
+	RegisterWorkloadKind(KindRollout, rolloutWorkloadAccessor{DynamicWorkloadAccessor{
+		Resource:        RolloutGVR,
+		PodTemplatePath: []string{"spec", "template"},
+	}})
+}
+
+// RolloutGVR is the GroupVersionResource of Argo Rollouts
+var RolloutGVR = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+// TypedWorkloadAccessor implements WorkloadAccessor for built-in kinds with the typed clientset.
+// TemplatePath holds the fields leading to the pod template, for example []string{"spec", "template"}.
+// ListFunc is optional, kinds without it can't be selected by labels.
+// RolloutFunc is optional, it reports whether changing the pod template of a fetched workload replaces its running pods,
+// which is assumed when it is not set.
+type TypedWorkloadAccessor struct {
+	Resource        schema.GroupResource
+	GetFunc         func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error)
+	ListFunc        func(ctx context.Context, clientset kubernetes.Interface, namespace string, opts v1.ListOptions) (runtime.Object, error)
+	PatchFunc       func(ctx context.Context, clientset kubernetes.Interface, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error
+	PodTemplateFunc func(object runtime.Object) *corev1.PodTemplateSpec
+	RolloutFunc     func(object runtime.Object) bool
+	TemplatePath    []string
+}
+
+func (accessor TypedWorkloadAccessor) Get(ctx context.Context, clients Clients, namespace string, name string) (runtime.Object, error) {
+	return accessor.GetFunc(ctx, clients.Kube, namespace, name)
+}
+
+func (accessor TypedWorkloadAccessor) PodTemplateAnnotations(object runtime.Object) map[string]string {
+	return accessor.PodTemplateFunc(object).Annotations
+}
+
+func (accessor TypedWorkloadAccessor) GroupResource() schema.GroupResource {
+	return accessor.Resource
+}
+
+func (accessor TypedWorkloadAccessor) AnnotationsPath() []string {
+	return podTemplateAnnotationsPath(accessor.TemplatePath)
+}
+
+func (accessor TypedWorkloadAccessor) Patch(ctx context.Context, clients Clients, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+	return accessor.PatchFunc(ctx, clients.Kube, namespace, name, patchType, data, opts)
+}
+
+func (accessor TypedWorkloadAccessor) TemplateChangeTriggersRollout(object runtime.Object) bool {
+	return accessor.RolloutFunc == nil || accessor.RolloutFunc(object)
+}
+
+func (accessor TypedWorkloadAccessor) List(ctx context.Context, clients Clients, namespace string, labelSelector string) ([]string, error) {
+	if accessor.ListFunc == nil {
+		return nil, ErrLabelSelectionUnsupported
+	}
+	list, err := accessor.ListFunc(ctx, clients.Kube, namespace, v1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, err
+	}
+	return objectNames(list)
+}
+
+// jobWorkloadAccessor annotates the CronJob instead of jobs created by a CronJob,
+// since those jobs are recreated from the CronJob's job template
+type jobWorkloadAccessor struct {
+	TypedWorkloadAccessor
+}
+
+func (accessor jobWorkloadAccessor) Resolve(ctx context.Context, clients Clients, namespace string, name string) (string, string, error) {
+	cronJobName, err := GetOwningCronJob(ctx, clients.Kube, namespace, name)
+	if err != nil {
+		return "", "", err
+	}
+	if cronJobName != "" {
+		return KindCronJob, cronJobName, nil
+	}
+	return KindJob, name, nil
+}
+
+// rolloutWorkloadAccessor annotates the referenced Deployment of Argo Rollouts that use spec.workloadRef
+// instead of their own pod template
+type rolloutWorkloadAccessor struct {
+	DynamicWorkloadAccessor
+}
+
+func (accessor rolloutWorkloadAccessor) Resolve(ctx context.Context, clients Clients, namespace string, name string) (string, string, error) {
+	object, err := accessor.Get(ctx, clients, namespace, name)
+	if err != nil {
+		return "", "", err
+	}
+	rollout := object.(*unstructured.Unstructured).Object
+	refKind, _, _ := unstructured.NestedString(rollout, "spec", "workloadRef", "kind")
+	refName, _, _ := unstructured.NestedString(rollout, "spec", "workloadRef", "name")
+	if strings.ToLower(refKind) == KindDeployment && refName != "" {
+		return KindDeployment, refName, nil
+	}
+	return KindRollout, name, nil
+}
+
+// TemplateChangeTriggersRollout is false for paused rollouts, which roll the change out when they are resumed
+func (accessor rolloutWorkloadAccessor) TemplateChangeTriggersRollout(object runtime.Object) bool {
+	paused, _, _ := unstructured.NestedBool(object.(*unstructured.Unstructured).Object, "spec", "paused")
+	return !paused
+}
+
+// DynamicWorkloadAccessor implements WorkloadAccessor for custom resources with the dynamic client.
+// Resource is the custom resource's GroupVersionResource and PodTemplatePath the fields leading
+// to its pod template, for example []string{"spec", "template"}.
+type DynamicWorkloadAccessor struct {
+	Resource        schema.GroupVersionResource
+	PodTemplatePath []string
+}
+
+func (accessor DynamicWorkloadAccessor) Get(ctx context.Context, clients Clients, namespace string, name string) (runtime.Object, error) {
+	return clients.Dynamic.Resource(accessor.Resource).Namespace(namespace).Get(ctx, name, v1.GetOptions{})
+}
+
+func (accessor DynamicWorkloadAccessor) PodTemplateAnnotations(object runtime.Object) map[string]string {
+	annotations, _, _ := unstructured.NestedStringMap(object.(*unstructured.Unstructured).Object, accessor.AnnotationsPath()...)
+	return annotations
+}
+
+func (accessor DynamicWorkloadAccessor) Patch(ctx context.Context, clients Clients, namespace string, name string, patchType types.PatchType, data []byte, opts v1.PatchOptions) error {
+	_, err := clients.Dynamic.Resource(accessor.Resource).Namespace(namespace).Patch(ctx, name, patchType, data, opts)
+	return err
+}
+
+func (accessor DynamicWorkloadAccessor) List(ctx context.Context, clients Clients, namespace string, labelSelector string) ([]string, error) {
+	list, err := clients.Dynamic.Resource(accessor.Resource).Namespace(namespace).List(ctx, v1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, err
+	}
+	return objectNames(list)
+}
+
+func (accessor DynamicWorkloadAccessor) GroupResource() schema.GroupResource {
+	return accessor.Resource.GroupResource()
+}
+
+func (accessor DynamicWorkloadAccessor) AnnotationsPath() []string {
+	return podTemplateAnnotationsPath(accessor.PodTemplatePath)
+}
+
+// podTemplateAnnotationsPath returns the fields leading to the annotations of the pod template at templatePath
+func podTemplateAnnotationsPath(templatePath []string) []string {
+	path := append([]string{}, templatePath...)
+	return append(path, "metadata", "annotations")
+}
+
+// RegisterCustomWorkloadKinds registers custom resource workload kinds from a configuration string of
+// semicolon separated `<kind>=<group>/<version>/<resource>:<pod template path>` entries, for example
+// `rollout=argoproj.io/v1alpha1/rollouts:spec.template`.
+// Nothing is registered when an entry is invalid.
+func RegisterCustomWorkloadKinds(config string) error {
+	accessors := map[string]DynamicWorkloadAccessor{}
+	var kinds []string
+	for _, entry := range strings.Split(config, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, rest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid custom workload kind %q: missing '='", entry)
+		}
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			return fmt.Errorf("invalid custom workload kind %q: missing kind", entry)
+		}
+		resource, path, ok := strings.Cut(strings.TrimSpace(rest), ":")
+		if !ok || path == "" {
+			return fmt.Errorf("invalid custom workload kind %q: missing pod template path", entry)
+		}
+		parts := strings.Split(resource, "/")
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return fmt.Errorf("invalid custom workload kind %q: resource must be <group>/<version>/<resource>", entry)
+		}
+		kinds = append(kinds, kind)
+		accessors[kind] = DynamicWorkloadAccessor{
+			Resource:        schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]},
+			PodTemplatePath: strings.Split(path, "."),
+		}
+	}
+	for _, kind := range kinds {
+		RegisterWorkloadKind(kind, accessors[kind])
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// restoreWorkloadKinds restores the workload registry when the test ends, for tests that register kinds
+func restoreWorkloadKinds(t *testing.T) {
+	accessors := map[string]WorkloadAccessor{}
+	for kind, accessor := range workloadAccessors {
+		accessors[kind] = accessor
+	}
+	kinds := append([]string{}, ValidKinds...)
+	t.Cleanup(func() {
+		workloadAccessors, ValidKinds = accessors, kinds
+	})
+}
+
+func TestBuiltInWorkloadKinds(t *testing.T) {
+	for _, kind := range []string{KindDeployment, KindStatefulSet, KindDaemonSet, KindCronJob, KindJob, KindRollout} {
+		if !IsValidKind(kind) {
+			t.Errorf("%s is not registered", kind)
+		}
+	}
+	if IsValidKind("pod") {
+		t.Error("pod is registered")
+	}
+}
+
+func TestRegisterWorkloadKind(t *testing.T) {
+	restoreWorkloadKinds(t)
+	before := len(ValidKinds)
+	accessor := DynamicWorkloadAccessor{Resource: schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}}
+	RegisterWorkloadKind("Widget", accessor)
+	if len(ValidKinds) != before+1 || ValidKinds[len(ValidKinds)-1] != "widget" {
+		t.Fatalf("ValidKinds = %v, want widget appended", ValidKinds)
+	}
+	// Registering a kind again replaces its accessor without duplicating it in ValidKinds
+	replacement := DynamicWorkloadAccessor{Resource: schema.GroupVersionResource{Group: "example.com", Version: "v2", Resource: "widgets"}}
+	RegisterWorkloadKind("widget", replacement)
+	if len(ValidKinds) != before+1 {
+		t.Errorf("ValidKinds = %v, want widget once", ValidKinds)
+	}
+	got, ok := GetWorkloadAccessor("WIDGET")
+	if !ok || !reflect.DeepEqual(got, replacement) {
+		t.Errorf("GetWorkloadAccessor(WIDGET) = %v, %v, want the replacement", got, ok)
+	}
+}
+
+func TestTypedWorkloadAccessor(t *testing.T) {
+	ctx := context.Background()
+	clients := Clients{Kube: fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "default", Labels: map[string]string{"team": "payments"}},
+			Spec:       deploymentSpec(map[string]string{"existing": "value"}),
+		},
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "default"}},
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "other", Namespace: "other", Labels: map[string]string{"team": "payments"}}},
+	)}
+	accessor, _ := GetWorkloadAccessor(KindDeployment)
+
+	object, err := accessor.Get(ctx, clients, "default", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations := accessor.PodTemplateAnnotations(object); !reflect.DeepEqual(annotations, map[string]string{"existing": "value"}) {
+		t.Errorf("annotations = %v", annotations)
+	}
+	if resource := accessor.GroupResource(); resource != (schema.GroupResource{Group: "apps", Resource: "deployments"}) {
+		t.Errorf("group resource = %v", resource)
+	}
+
+	patch := []byte(`{"spec":{"template":{"metadata":{"annotations":{"added":"true"}}}}}`)
+	if err := accessor.Patch(ctx, clients, "default", "api", types.MergePatchType, patch, v1.PatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	object, _ = accessor.Get(ctx, clients, "default", "api")
+	if annotations := accessor.PodTemplateAnnotations(object); !reflect.DeepEqual(annotations, map[string]string{"existing": "value", "added": "true"}) {
+		t.Errorf("annotations after patch = %v", annotations)
+	}
+
+	names, err := accessor.(WorkloadLister).List(ctx, clients, "default", "team=payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"api"}) {
+		t.Errorf("names = %v, want [api]", names)
+	}
+
+	// Jobs have no ListFunc, they can't be selected by labels
+	jobs, _ := GetWorkloadAccessor(KindJob)
+	if _, err := jobs.(WorkloadLister).List(ctx, clients, "default", ""); err != ErrLabelSelectionUnsupported {
+		t.Errorf("listing jobs returned %v, want ErrLabelSelectionUnsupported", err)
+	}
+}
+
+func TestDynamicWorkloadAccessor(t *testing.T) {
+	ctx := context.Background()
+	gvr := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	widget := func(name string, labels map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1",
+			"kind":       "Widget",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "default", "labels": labels},
+			"spec": map[string]interface{}{
+				"podTemplate": map[string]interface{}{
+					"metadata": map[string]interface{}{"annotations": map[string]interface{}{"existing": "value"}},
+				},
+			},
+		}}
+	}
+	clients := Clients{Dynamic: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "WidgetList"},
+		widget("blue", map[string]interface{}{"color": "blue"}),
+		widget("red", map[string]interface{}{"color": "red"}),
+	)}
+	accessor := DynamicWorkloadAccessor{Resource: gvr, PodTemplatePath: []string{"spec", "podTemplate"}}
+
+	if path := accessor.AnnotationsPath(); !reflect.DeepEqual(path, []string{"spec", "podTemplate", "metadata", "annotations"}) {
+		t.Errorf("annotations path = %v", path)
+	}
+	patch := []byte(`{"spec":{"podTemplate":{"metadata":{"annotations":{"added":"true"}}}}}`)
+	if err := accessor.Patch(ctx, clients, "default", "blue", types.MergePatchType, patch, v1.PatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	object, err := accessor.Get(ctx, clients, "default", "blue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations := accessor.PodTemplateAnnotations(object); !reflect.DeepEqual(annotations, map[string]string{"existing": "value", "added": "true"}) {
+		t.Errorf("annotations after patch = %v", annotations)
+	}
+
+	names, err := accessor.List(ctx, clients, "default", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"blue", "red"}) {
+		t.Errorf("names = %v, want [blue red]", names)
+	}
+}
+
+func TestRegisterCustomWorkloadKinds(t *testing.T) {
+	restoreWorkloadKinds(t)
+	err := RegisterCustomWorkloadKinds(" cloneset = apps.kruise.io/v1alpha1/clonesets:spec.template ; ;widget=example.com/v1/widgets:spec.podTemplate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessor, ok := GetWorkloadAccessor("cloneset")
+	want := DynamicWorkloadAccessor{
+		Resource:        schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1alpha1", Resource: "clonesets"},
+		PodTemplatePath: []string{"spec", "template"},
+	}
+	if !ok || !reflect.DeepEqual(accessor, want) {
+		t.Errorf("cloneset accessor = %+v, want %+v", accessor, want)
+	}
+	if !IsValidKind("widget") {
+		t.Error("widget is not registered")
+	}
+}
+
+func TestRegisterCustomWorkloadKindsErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing equal sign":     "cloneset",
+		"missing kind":           "=apps.kruise.io/v1alpha1/clonesets:spec.template",
+		"blank kind":             "  =apps.kruise.io/v1alpha1/clonesets:spec.template",
+		"missing template path":  "cloneset=apps.kruise.io/v1alpha1/clonesets",
+		"empty template path":    "cloneset=apps.kruise.io/v1alpha1/clonesets:",
+		"missing version":        "cloneset=apps.kruise.io/clonesets:spec.template",
+		"empty resource":         "cloneset=apps.kruise.io/v1alpha1/:spec.template",
+		"invalid second entry":   "widget=example.com/v1/widgets:spec.template;cloneset",
+		"too many resource path": "cloneset=apps.kruise.io/v1alpha1/clonesets/status:spec.template",
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			restoreWorkloadKinds(t)
+			before := append([]string{}, ValidKinds...)
+			err := RegisterCustomWorkloadKinds(config)
+			if err == nil || !strings.HasPrefix(err.Error(), "invalid custom workload kind") {
+				t.Errorf("error = %v, want an invalid custom workload kind error", err)
+			}
+			// Nothing is registered when an entry is invalid
+			if !reflect.DeepEqual(ValidKinds, before) {
+				t.Errorf("ValidKinds = %v, want %v", ValidKinds, before)
+			}
+		})
+	}
+}
+
+// deploymentSpec returns a deployment spec whose pod template has the given annotations
+func deploymentSpec(annotations map[string]string) appsv1.DeploymentSpec {
+	spec := appsv1.DeploymentSpec{}
+	spec.Template.Annotations = annotations
+	return spec
+}
+
+func TestRolloutWorkloadRef(t *testing.T) {
+	rollout := func(name string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "argoproj.io/v1alpha1",
+			"kind":       "Rollout",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+			"spec":       spec,
+		}}
+	}
+	clients := Clients{
+		Kube: fake.NewSimpleClientset(&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "checkout", Namespace: "default"}}),
+		Dynamic: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+			rollout("with-template", map[string]interface{}{"template": map[string]interface{}{}}),
+			rollout("with-ref", map[string]interface{}{
+				"workloadRef": map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment", "name": "checkout"},
+			}),
+		),
+	}
+	tests := []struct {
+		name         string
+		expectedKind string
+		expectedName string
+	}{
+		{"with-template", KindRollout, "with-template"},
+		{"with-ref", KindDeployment, "checkout"},
+	}
+	for _, test := range tests {
+		kind, name, err := ResolveWorkload(context.Background(), clients, KindRollout, "default", test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != test.expectedKind || name != test.expectedName {
+			t.Errorf("%s resolved to %s/%s, want %s/%s", test.name, kind, name, test.expectedKind, test.expectedName)
+		}
+	}
+}
+
+func TestTemplateChangeTriggersRollout(t *testing.T) {
+	clients := Clients{
+		Kube: fake.NewSimpleClientset(
+			&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "running", Namespace: "default"}},
+			&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "paused", Namespace: "default"}, Spec: appsv1.DeploymentSpec{Paused: true}},
+			&appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "rolling", Namespace: "default"}},
+			&appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "ondelete", Namespace: "default"}, Spec: appsv1.StatefulSetSpec{
+				UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+			}},
+			&appsv1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "rolling", Namespace: "default"}},
+			&appsv1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "ondelete", Namespace: "default"}, Spec: appsv1.DaemonSetSpec{
+				UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType},
+			}},
+			&batchv1.CronJob{ObjectMeta: v1.ObjectMeta{Name: "report", Namespace: "default"}},
+			&batchv1.Job{ObjectMeta: v1.ObjectMeta{Name: "migrate", Namespace: "default"}},
+		),
+		Dynamic: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+			&unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "argoproj.io/v1alpha1",
+				"kind":       "Rollout",
+				"metadata":   map[string]interface{}{"name": "running", "namespace": "default"},
+			}},
+			&unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "argoproj.io/v1alpha1",
+				"kind":       "Rollout",
+				"metadata":   map[string]interface{}{"name": "paused", "namespace": "default"},
+				"spec":       map[string]interface{}{"paused": true},
+			}},
+		),
+	}
+	tests := []struct {
+		kind     string
+		name     string
+		expected bool
+	}{
+		{KindDeployment, "running", true},
+		{KindDeployment, "paused", false},
+		{KindStatefulSet, "rolling", true},
+		{KindStatefulSet, "ondelete", false},
+		{KindDaemonSet, "rolling", true},
+		{KindDaemonSet, "ondelete", false},
+		{KindCronJob, "report", false},
+		{KindJob, "migrate", false},
+		{KindRollout, "running", true},
+		{KindRollout, "paused", false},
+	}
+	for _, test := range tests {
+		accessor, _ := GetWorkloadAccessor(test.kind)
+		object, err := accessor.Get(context.Background(), clients, "default", test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if triggered := templateChangeTriggersRollout(accessor, object); triggered != test.expected {
+			t.Errorf("%s/%s triggers a rollout = %v, want %v", test.kind, test.name, triggered, test.expected)
+		}
+	}
+	// Custom kinds are assumed to replace their pods
+	custom := DynamicWorkloadAccessor{Resource: schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}}
+	if !templateChangeTriggersRollout(custom, &unstructured.Unstructured{}) {
+		t.Error("custom kind doesn't trigger a rollout")
+	}
+}
@@ -1,23 +1,110 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/logzio/ezkonnect-server/api"
 	annotateapi "github.com/logzio/ezkonnect-server/api/annotate"
+	"github.com/logzio/ezkonnect-server/api/audit"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	healthapi "github.com/logzio/ezkonnect-server/api/health"
+	"github.com/logzio/ezkonnect-server/api/metrics"
 	stateapi "github.com/logzio/ezkonnect-server/api/state"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
+// customWorkloadKindsEnv holds additional workload kinds that can be annotated through the dynamic client
+const customWorkloadKindsEnv = "CUSTOM_WORKLOAD_KINDS"
+
 // main starts the server. Endpoints:
 // 1. /api/v1/state - returns a list of all custom resources of type InstrumentedApplication
-// 2. /api/v1/annotate/traces - handles the POST request for annotating a supported resource kind
-// 3. /api/v1/annotate/logs - handles the POST request for annotating a supported resource kind with log annotations
+// 2. /api/v1/state/stream - streams changes to custom resources of type InstrumentedApplication as Server-Sent Events
+// 3. /api/v1/state/{namespace}/{kind}/{name} - returns the state of a single workload
+// 4. /api/v1/annotate/traces - handles the POST request for annotating a supported resource kind
+// 5. /api/v1/annotate/traces/auto - handles the POST request for instrumenting all the workloads ready for automatic instrumentation
+// 6. /api/v1/annotate/logs - handles the POST request for annotating a supported resource kind with log annotations
+// 7. /api/v1/audit - returns the audit trail of the annotate operations
+// 8. /healthz - liveness probe, reports that the process is up
+// 9. /readyz - readiness probe, checks the Kubernetes API server, the InstrumentedApplication CRD and cache
+// 10. /metrics - Prometheus metrics
+// Every endpoint except the probes and metrics requires a bearer token when authentication is enabled, see auth.Middleware.
+// The server is configured with flags and environment variables, see loadServerConfig,
+// and shuts down gracefully on SIGTERM or SIGINT.
 func main() {
+	serverConfig, err := loadServerConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Register custom resource workload kinds, see api.RegisterCustomWorkloadKinds for the format
+	if err := api.RegisterCustomWorkloadKinds(os.Getenv(customWorkloadKindsEnv)); err != nil {
+		log.Fatal(err)
+	}
+	// Report the Kubernetes client requests before any client is created
+	metrics.RegisterKubernetesClientMetrics()
+	config, err := api.GetConfig()
+	if err != nil {
+		log.Fatal(api.ErrorKubeConfig, err)
+	}
+	// Every handler gets its clients from the factory, derived from the config for impersonated requests
+	clientFactory := api.NewClientFactory(config)
+	api.SetClientFactory(clientFactory)
+	clients, err := clientFactory.Clients()
+	if err != nil {
+		log.Fatal(api.ErrorKubeClient, err)
+	}
+	clientset := clients.Kube
+	authenticator, err := auth.New(serverConfig.authMode, serverConfig.authTokenFile, clientset)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.ConfigureAuthorization(serverConfig.authorizationMode, serverConfig.authMode, clientset); err != nil {
+		log.Fatal(err)
+	}
+	if err := audit.Configure(serverConfig.auditSinks, serverConfig.auditFile, clientset); err != nil {
+		log.Fatal(err)
+	}
+	defer audit.Shutdown()
+	if authenticator == nil {
+		log.Println("Warning: authentication is disabled, every client that can reach the server can change workloads")
+	}
+	// Kubernetes sends SIGTERM when the pod is terminated
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	// Start the InstrumentedApplication cache before serving so the state endpoint can warm up
+	if err := stateapi.StartInformer(ctx, config); err != nil {
+		log.Fatal(api.ErrorDynamic, err)
+	}
+
 	router := mux.NewRouter().StrictSlash(true)
+	// Count the rejected requests too, authentication runs after metrics.
+	// Request ids are assigned first so every response carries one.
+	router.Use(audit.RequestMiddleware, metrics.Middleware, auth.Middleware(authenticator))
+	server := newServer(serverConfig, router)
 	router.HandleFunc("/api/v1/state", stateapi.GetCustomResourcesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/state/stream", closeOnShutdown(server, withoutWriteTimeout(stateapi.StreamCustomResourcesHandler))).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/state/{namespace}/{kind}/{name}", stateapi.GetCustomResourceHandler).Methods(http.MethodGet)
 	router.HandleFunc("/api/v1/annotate/traces", annotateapi.UpdateTracesResourceAnnotations).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/annotate/traces/auto", annotateapi.AutoInstrumentTraces).Methods(http.MethodPost)
 	router.HandleFunc("/api/v1/annotate/logs", annotateapi.UpdateLogsResourceAnnotations).Methods(http.MethodPost)
-	fmt.Println("Starting server on :5050")
-	log.Fatal(http.ListenAndServe(":5050", router))
+	router.HandleFunc("/api/v1/audit", audit.GetAuditEntriesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/healthz", healthapi.LivenessHandler).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", healthapi.ReadinessHandler).Methods(http.MethodGet)
+	router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	listener, err := net.Listen("tcp", serverConfig.address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Starting server on " + serverConfig.address)
+	if err := runServer(ctx, server, listener, serverConfig.shutdownTimeout); err != nil {
+		// log.Fatal skips the deferred calls, flush the audit trail first
+		stop()
+		audit.Shutdown()
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/logzio/ezkonnect-server/api/audit"
+	"github.com/logzio/ezkonnect-server/api/auth"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables that set the defaults of the server flags
+const (
+	listenAddressEnv     = "LISTEN_ADDRESS"
+	readTimeoutEnv       = "READ_TIMEOUT"
+	readHeaderTimeoutEnv = "READ_HEADER_TIMEOUT"
+	writeTimeoutEnv      = "WRITE_TIMEOUT"
+	idleTimeoutEnv       = "IDLE_TIMEOUT"
+	maxHeaderBytesEnv    = "MAX_HEADER_BYTES"
+	shutdownTimeoutEnv   = "SHUTDOWN_TIMEOUT"
+	authModeEnv          = "AUTH_MODE"
+	authTokenFileEnv     = "AUTH_TOKEN_FILE"
+	authorizationModeEnv = "AUTHORIZATION_MODE"
+	auditSinksEnv        = "AUDIT_SINKS"
+	auditFileEnv         = "AUDIT_FILE"
+)
+
+// serverConfig is the configuration of the HTTP server, see loadServerConfig
+// shutdownTimeout: how long in-flight requests are drained on shutdown before their connections are closed
+// authMode: how requests are authenticated, see auth.New
+// authTokenFile: the static token file of the static authentication mode
+// authorizationMode: how the callers' permissions are checked, see auth.ConfigureAuthorization.
+// It defaults to subjectaccessreview when requests are authenticated, none must be set explicitly to opt out.
+// auditSinks: comma separated sinks of the audit trail, see audit.Configure
+// auditFile: the JSON-lines file of the file audit sink
+type serverConfig struct {
+	address           string
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	shutdownTimeout   time.Duration
+	authMode          string
+	authTokenFile     string
+	authorizationMode string
+	auditSinks        string
+	auditFile         string
+}
+
+// defaultServerConfig keeps the shutdown timeout below the default Kubernetes termination grace period of 30 seconds,
+// and emits Kubernetes Events on the changed workloads
+var defaultServerConfig = serverConfig{
+	address:           ":5050",
+	readTimeout:       30 * time.Second,
+	readHeaderTimeout: 10 * time.Second,
+	writeTimeout:      5 * time.Minute,
+	idleTimeout:       2 * time.Minute,
+	maxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	shutdownTimeout:   25 * time.Second,
+	authMode:          auth.ModeNone,
+	auditSinks:        audit.SinkLog + "," + audit.SinkEvent,
+}
+
+// loadServerConfig builds the server configuration from the command line flags.
+// The flags default to their environment variable, and to defaultServerConfig when it is not set.
+func loadServerConfig(args []string, getenv func(string) string) (serverConfig, error) {
+	config := defaultServerConfig
+	var err error
+	if value := getenv(listenAddressEnv); value != "" {
+		config.address = value
+	}
+	if value := getenv(authModeEnv); value != "" {
+		config.authMode = value
+	}
+	if value := getenv(authTokenFileEnv); value != "" {
+		config.authTokenFile = value
+	}
+	if value := getenv(authorizationModeEnv); value != "" {
+		config.authorizationMode = value
+	}
+	if value := getenv(auditSinksEnv); value != "" {
+		config.auditSinks = value
+	}
+	if value := getenv(auditFileEnv); value != "" {
+		config.auditFile = value
+	}
+	durations := []struct {
+		env   string
+		value *time.Duration
+	}{
+		{readTimeoutEnv, &config.readTimeout},
+		{readHeaderTimeoutEnv, &config.readHeaderTimeout},
+		{writeTimeoutEnv, &config.writeTimeout},
+		{idleTimeoutEnv, &config.idleTimeout},
+		{shutdownTimeoutEnv, &config.shutdownTimeout},
+	}
+	for _, duration := range durations {
+		if value := getenv(duration.env); value != "" {
+			*duration.value, err = time.ParseDuration(value)
+			if err != nil {
+				return config, fmt.Errorf("invalid %s: %v", duration.env, err)
+			}
+		}
+	}
+	if value := getenv(maxHeaderBytesEnv); value != "" {
+		config.maxHeaderBytes, err = strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %v", maxHeaderBytesEnv, err)
+		}
+	}
+
+	flags := flag.NewFlagSet("ezkonnect-server", flag.ContinueOnError)
+	flags.StringVar(&config.address, "listen-address", config.address, "address the server listens on (env "+listenAddressEnv+")")
+	flags.DurationVar(&config.readTimeout, "read-timeout", config.readTimeout, "maximum duration for reading a request including its body (env "+readTimeoutEnv+")")
+	flags.DurationVar(&config.readHeaderTimeout, "read-header-timeout", config.readHeaderTimeout, "maximum duration for reading request headers (env "+readHeaderTimeoutEnv+")")
+	flags.DurationVar(&config.writeTimeout, "write-timeout", config.writeTimeout, "maximum duration of a response, 0 disables it (env "+writeTimeoutEnv+")")
+	flags.DurationVar(&config.idleTimeout, "idle-timeout", config.idleTimeout, "maximum duration a keep-alive connection stays idle (env "+idleTimeoutEnv+")")
+	flags.IntVar(&config.maxHeaderBytes, "max-header-bytes", config.maxHeaderBytes, "maximum size of request headers (env "+maxHeaderBytesEnv+")")
+	flags.DurationVar(&config.shutdownTimeout, "shutdown-timeout", config.shutdownTimeout, "how long in-flight requests are drained on shutdown (env "+shutdownTimeoutEnv+")")
+	flags.StringVar(&config.authMode, "auth-mode", config.authMode, "request authentication: none, tokenreview or static (env "+authModeEnv+")")
+	flags.StringVar(&config.authTokenFile, "auth-token-file", config.authTokenFile, "token file of the static authentication mode (env "+authTokenFileEnv+")")
+	flags.StringVar(&config.authorizationMode, "authorization-mode", config.authorizationMode, "caller permission checks: none, subjectaccessreview or impersonate, defaults to subjectaccessreview with an authentication mode (env "+authorizationModeEnv+")")
+	flags.StringVar(&config.auditSinks, "audit-sinks", config.auditSinks, "comma separated audit sinks: log, file and event (env "+auditSinksEnv+")")
+	flags.StringVar(&config.auditFile, "audit-file", config.auditFile, "JSON-lines file of the file audit sink (env "+auditFileEnv+")")
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+	// Authenticated callers only change the workloads they are allowed to change, unless explicitly disabled
+	if config.authorizationMode == "" {
+		config.authorizationMode = auth.AuthorizationNone
+		if config.authMode != "" && !strings.EqualFold(config.authMode, auth.ModeNone) {
+			config.authorizationMode = auth.AuthorizationSubjectAccessReview
+		}
+	}
+	return config, nil
+}
+
+// connContextKey is the request context key of the request's connection, see withoutWriteTimeout
+type connContextKey struct{}
+
+// newServer builds the HTTP server serving handler from the configuration
+func newServer(config serverConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              config.address,
+		Handler:           handler,
+		ReadTimeout:       config.readTimeout,
+		ReadHeaderTimeout: config.readHeaderTimeout,
+		WriteTimeout:      config.writeTimeout,
+		IdleTimeout:       config.idleTimeout,
+		MaxHeaderBytes:    config.maxHeaderBytes,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, conn)
+		},
+	}
+}
+
+// runServer serves on listener until ctx is cancelled, then stops accepting connections and waits up to shutdownTimeout
+// for the in-flight requests to complete before closing the remaining connections
+func runServer(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down, draining in-flight requests for up to", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// closeOnShutdown cancels the context of long-lived requests such as streams when the server shuts down,
+// since Shutdown waits for active requests and would otherwise wait for them until the shutdown timeout
+func closeOnShutdown(server *http.Server, handler http.HandlerFunc) http.HandlerFunc {
+	shutdown := make(chan struct{})
+	server.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-shutdown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// withoutWriteTimeout exempts long-lived requests such as streams from the server's write timeout,
+// which would otherwise cut them when it elapses. The server sets the write deadline of the connection
+// before calling the handler and again before reading the next request, so clearing it only affects this request.
+func withoutWriteTimeout(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+			conn.SetWriteDeadline(time.Time{})
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startServer runs a server for handler on a random local port, it returns the server's URL, a function that shuts it down
+// and the channel receiving the result of runServer
+func startServer(t *testing.T, config serverConfig, handler func(server *http.Server) http.Handler) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(config, nil)
+	server.Handler = handler(server)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	result := make(chan error, 1)
+	go func() {
+		result <- runServer(ctx, server, listener, config.shutdownTimeout)
+	}()
+	return "http://" + listener.Addr().String(), cancel, result
+}
+
+// response is the outcome of a request made in the background
+type response struct {
+	status int
+	body   string
+	err    error
+}
+
+// get requests url in the background
+func get(url string) <-chan response {
+	result := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			result <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		result <- response{status: resp.StatusCode, body: string(body), err: err}
+	}()
+	return result
+}
+
+// waitFor fails the test when the channel doesn't receive a value in time
+func waitFor[T any](t *testing.T, channel <-chan T, what string) T {
+	t.Helper()
+	select {
+	case value := <-channel:
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+func TestRunServerDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	url, shutdown, result := startServer(t, defaultServerConfig, func(*http.Server) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("done"))
+		})
+	})
+	request := get(url)
+	waitFor(t, started, "the request")
+	shutdown()
+
+	resp := waitFor(t, request, "the response")
+	if resp.err != nil || resp.status != http.StatusOK || resp.body != "done" {
+		t.Errorf("response = %+v, want the in-flight request to complete", resp)
+	}
+	if err := waitFor(t, result, "the shutdown"); err != nil {
+		t.Errorf("runServer returned %v", err)
+	}
+}
+
+func TestCloseOnShutdownCancelsStreams(t *testing.T) {
+	config := defaultServerConfig
+	config.shutdownTimeout = time.Minute
+	started := make(chan struct{})
+	url, shutdown, result := startServer(t, config, func(server *http.Server) http.Handler {
+		return closeOnShutdown(server, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("event\n"))
+			w.(http.Flusher).Flush()
+			close(started)
+			<-r.Context().Done()
+		})
+	})
+	request := get(url)
+	waitFor(t, started, "the stream")
+	start := time.Now()
+	shutdown()
+
+	if err := waitFor(t, result, "the shutdown"); err != nil {
+		t.Errorf("runServer returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v, want the stream to be cancelled right away", elapsed)
+	}
+	if resp := waitFor(t, request, "the response"); resp.err != nil || resp.body != "event\n" {
+		t.Errorf("response = %+v, want the stream to end", resp)
+	}
+}
+
+func TestRunServerShutdownTimeout(t *testing.T) {
+	config := defaultServerConfig
+	config.shutdownTimeout = 50 * time.Millisecond
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	url, shutdown, result := startServer(t, config, func(*http.Server) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+	})
+	request := get(url)
+	waitFor(t, started, "the request")
+	shutdown()
+
+	err := waitFor(t, result, "the shutdown")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runServer returned %v, want a shutdown timeout", err)
+	}
+	// The remaining connections are closed
+	if resp := waitFor(t, request, "the response"); resp.err == nil {
+		t.Errorf("response = %+v, want the connection to be closed", resp)
+	}
+}
+
+func TestWithoutWriteTimeout(t *testing.T) {
+	config := defaultServerConfig
+	config.writeTimeout = 100 * time.Millisecond
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("second\n"))
+	}
+	url, _, _ := startServer(t, config, func(*http.Server) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/limited", stream)
+		mux.HandleFunc("/stream", withoutWriteTimeout(stream))
+		return mux
+	})
+
+	if resp := waitFor(t, get(url+"/stream"), "the stream"); resp.err != nil || resp.body != "first\nsecond\n" {
+		t.Errorf("stream response = %+v, want both writes", resp)
+	}
+	if resp := waitFor(t, get(url+"/limited"), "the limited response"); resp.err == nil && resp.body == "first\nsecond\n" {
+		t.Errorf("limited response = %+v, want it to be cut by the write timeout", resp)
+	}
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected func(config *serverConfig)
+	}{
+		{
+			name: "defaults",
+			expected: func(config *serverConfig) {
+				config.authorizationMode = "none"
+			},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				listenAddressEnv:   ":8080",
+				writeTimeoutEnv:    "1m",
+				maxHeaderBytesEnv:  "4096",
+				authModeEnv:        "tokenreview",
+				auditSinksEnv:      "file",
+				auditFileEnv:       "/var/lib/ezkonnect/audit.jsonl",
+				shutdownTimeoutEnv: "5s",
+			},
+			expected: func(config *serverConfig) {
+				config.address = ":8080"
+				config.writeTimeout = time.Minute
+				config.maxHeaderBytes = 4096
+				config.authMode = "tokenreview"
+				config.authorizationMode = "subjectaccessreview"
+				config.auditSinks = "file"
+				config.auditFile = "/var/lib/ezkonnect/audit.jsonl"
+				config.shutdownTimeout = 5 * time.Second
+			},
+		},
+		{
+			name: "flags override the environment",
+			args: []string{"--listen-address", ":9090", "--write-timeout=0", "--auth-mode", "static"},
+			env:  map[string]string{listenAddressEnv: ":8080", writeTimeoutEnv: "1m", authModeEnv: "tokenreview", readTimeoutEnv: "10s"},
+			expected: func(config *serverConfig) {
+				config.address = ":9090"
+				config.writeTimeout = 0
+				config.authMode = "static"
+				config.authorizationMode = "subjectaccessreview"
+				config.readTimeout = 10 * time.Second
+			},
+		},
+		{
+			name: "authorization opt-out",
+			env:  map[string]string{authModeEnv: "tokenreview", authorizationModeEnv: "none"},
+			expected: func(config *serverConfig) {
+				config.authMode = "tokenreview"
+				config.authorizationMode = "none"
+			},
+		},
+		{
+			name: "impersonation",
+			args: []string{"--authorization-mode", "impersonate"},
+			env:  map[string]string{authModeEnv: "tokenreview"},
+			expected: func(config *serverConfig) {
+				config.authMode = "tokenreview"
+				config.authorizationMode = "impersonate"
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := loadServerConfig(test.args, func(key string) string { return test.env[key] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := defaultServerConfig
+			test.expected(&expected)
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("config = %+v, want %+v", config, expected)
+			}
+		})
+	}
+}
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"invalid duration variable", nil, map[string]string{readTimeoutEnv: "soon"}},
+		{"invalid max header bytes variable", nil, map[string]string{maxHeaderBytesEnv: "large"}},
+		{"invalid duration flag", []string{"--shutdown-timeout", "soon"}, nil},
+		{"unknown flag", []string{"--unknown"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := loadServerConfig(test.args, func(key string) string { return test.env[key] }); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}